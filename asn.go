@@ -0,0 +1,111 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// asnTable maps address prefixes to the ASN originating them, matching the longest prefix
+type asnTable struct {
+	// prefixes keyed by length, then by the masked address
+	prefixes map[int]map[string]string
+	lengths  []int // prefix lengths in the table, longest first
+}
+
+// asns is loaded from -asn-file, nil if no file was given
+var asns *asnTable
+
+// loadASNTable reads a prefix to ASN file, see parseASNTable
+func loadASNTable(path string) (*asnTable, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseASNTable(file, path)
+}
+
+// parseASNTable parses lines of either "prefix/length ASN" or "address length ASN" like CAIDA's pfx2as files,
+// empty lines and lines starting with # are skipped
+func parseASNTable(r io.Reader, file string) (*asnTable, error) {
+	t := &asnTable{prefixes: make(map[int]map[string]string)}
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		prefix, asn := "", ""
+		switch len(fields) {
+		case 2:
+			prefix, asn = fields[0], fields[1]
+		case 3:
+			prefix, asn = fields[0]+"/"+fields[1], fields[2]
+		default:
+			return nil, fmt.Errorf("%s:%d: expected prefix and ASN, got %q", file, line, scanner.Text())
+		}
+		_, ipNet, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, line, err)
+		}
+		t.add(ipNet, strings.TrimPrefix(strings.ToUpper(asn), "AS"))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(t.lengths) == 0 {
+		return nil, fmt.Errorf("no prefixes in %s", file)
+	}
+	return t, nil
+}
+
+func (t *asnTable) add(ipNet *net.IPNet, asn string) {
+	ones, bits := ipNet.Mask.Size()
+	// keep IPv4 and IPv6 lengths apart
+	length := ones + bits - 32
+	if _, ok := t.prefixes[length]; !ok {
+		t.prefixes[length] = make(map[string]string)
+		t.lengths = append(t.lengths, length)
+		sort.Sort(sort.Reverse(sort.IntSlice(t.lengths)))
+	}
+	t.prefixes[length][ipNet.IP.String()] = asn
+}
+
+// Lookup returns the ASN of the longest prefix containing ip, or "" if there is none
+func (t *asnTable) Lookup(ip net.IP) string {
+	bits := 128
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 32
+	}
+	for _, length := range t.lengths {
+		ones := length - bits + 32
+		if ones < 0 || ones > bits {
+			continue
+		}
+		if asn, ok := t.prefixes[length][ip.Mask(net.CIDRMask(ones, bits)).String()]; ok {
+			return asn
+		}
+	}
+	return ""
+}
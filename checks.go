@@ -14,57 +14,234 @@
 
 package main
 
-import "github.com/miekg/dns"
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/errgroup"
+)
 
 func checkEqualResultResponse(r *queryGroup) uint {
 	totalServers := len(r.NS)
 	var found uint = 0
 
 	for server := range r.Results {
-		if r.Results[server].Err != nil {
+		if len(r.Results[server].Addrs) == 0 {
+			// no addresses could be found to query
 			finding("ERROR server: %q @%s: %s", r.Domain, server, r.Results[server].Err)
 			found++
-		} else {
-			// only check for different responses if the query did not error
-			serverResponses := len(r.Results[server].NS)
-			if serverResponses != totalServers {
-				missing := ExtraStrings(r.NS, r.Results[server].NS)
-				finding("varying responses: expected %d, got %d, for %q @%s. missing: %v", totalServers, serverResponses, r.Domain, server, missing)
+			continue
+		}
+		for addr, result := range r.Results[server].Addrs {
+			if result.Err != nil {
+				finding("ERROR server: %q @%s: %s", r.Domain, serverAddr(server, addr), result.Err)
 				found++
+			} else {
+				// only check for different responses if the query did not error
+				serverResponses := len(result.NS)
+				if serverResponses != totalServers {
+					missing := ExtraStrings(r.NS, result.NS)
+					finding("varying responses: expected %d, got %d, for %q @%s. missing: %v", totalServers, serverResponses, r.Domain, serverAddr(server, addr), missing)
+					found++
+				}
 			}
 		}
 	}
 	return found
 }
 
-func checkLame(q *queryGroup) bool {
+// lameness records if a delegation was lame, and over which address families
+type lameness struct {
+	Lame bool
+	IPv4 bool
+	IPv6 bool
+}
+
+// checkLame queries the nameservers delegated to in q, and returns the authoritative results for use by other checks
+func checkLame(q *queryGroup) (lameness, *queryGroup) {
 	//v("checkLame(%q)", q.Domain)
 	r, err := queryNSParallel(q.Domain, q.NS)
-	lame := false
+	var lame lameness
 	if err != nil {
 		finding("ERROR querying authoritative: %s %s", q.Domain, err)
-		return true
+		lame.Lame = true
+		return lame, nil
 	}
 	v("checkLame(%q) query result: \n\t%+v", q.Domain, r.String())
 
 	if !StringArrayEquals(q.NS, r.NS) {
-		lame = true
+		lame.Lame = true
 		finding("unexpected difference in nameservers: domain: %q expected %d: %v, got %d: %v", q.Domain, len(q.NS), q.NS, len(r.NS), r.NS)
 		extra := ExtraStrings(r.NS, q.NS)
 		if len(extra) > 0 {
 			finding("> extra nameservers returned by authoritative NS: %q: %v", q.Domain, ExtraStrings(r.NS, q.NS))
-			// TODO extra nameservers can also be lame, check
 		}
 	}
+	checkChildOnly(q, r)
 
-	// check that the authoritative bit is set
+	// check that every address gave an authoritative answer
 	for nameserver := range r.Results {
-		if !r.Results[nameserver].Authoritative {
-			lame = true
-			finding("lame delegation: %q is not authoritative for %q", nameserver, r.Domain)
+		where := ""
+		if r.Results[nameserver].ChildOnly {
+			where = " (child-only)"
+		}
+		if len(r.Results[nameserver].Addrs) == 0 {
+			lame.Lame = true
+			finding("lame delegation (%s): %q%s for %q: %s", lameNoAddress, nameserver, where, r.Domain, r.Results[nameserver].Err)
+		}
+		// track which families the nameserver answered correctly over
+		working := make(map[string]bool)
+		broken := make(map[string]bool)
+		kinds := make(map[string]bool)
+		var lameAddrs, lameKinds, lameDetails []string
+		for _, addr := range r.Results[nameserver].sortedAddrs() {
+			family := ipFamily(net.ParseIP(addr))
+			if kind, detail := classifyLame(r.Results[nameserver].Addrs[addr], r.Domain); kind != "" {
+				lame.Lame = true
+				broken[family] = true
+				kinds[kind] = true
+				lameAddrs, lameKinds, lameDetails = append(lameAddrs, addr), append(lameKinds, kind), append(lameDetails, detail)
+			} else {
+				working[family] = true
+			}
+		}
+		// lame on every address the same way its provider answers for zones it does not host, so the zone can often be claimed
+		if fp := matchFingerprint(nameserver, stringMapToArrayKeys(kinds)); fp != nil && len(working) == 0 {
+			kindList := stringMapToArrayKeys(kinds)
+			sort.Strings(kindList)
+			highFinding("potentially claimable delegation (%s): %q%s for %q answers %v, which %s gives for zones that are not hosted in any account",
+				fp.Provider, nameserver, where, r.Domain, kindList, fp.Provider)
+		} else {
+			for i, addr := range lameAddrs {
+				finding("lame delegation (%s): %q%s for %q: %s", lameKinds[i], serverAddr(nameserver, addr), where, r.Domain, lameDetails[i])
+			}
+		}
+		lame.IPv4 = lame.IPv4 || broken[familyIPv4]
+		lame.IPv6 = lame.IPv6 || broken[familyIPv6]
+		if working[familyIPv4] && broken[familyIPv6] && !broken[familyIPv4] {
+			finding("lame over IPv6 only: %q is authoritative for %q over IPv4 but not over IPv6", nameserver, r.Domain)
+		}
+		if working[familyIPv6] && broken[familyIPv4] && !broken[familyIPv6] {
+			finding("lame over IPv4 only: %q is authoritative for %q over IPv6 but not over IPv4", nameserver, r.Domain)
 		}
 	}
-	return lame
+	return lame, r
+}
+
+// checkChildOnly queries the nameservers only listed by the authoritative servers in r, and adds their results to r marked
+// as child-only. Resolvers use them once they cache the authoritative NS set, so they are checked like the delegated
+// ones, including any further nameservers they list.
+func checkChildOnly(q, r *queryGroup) {
+	authNS := r.NS
+	checked := StringArrayToMap(q.NS)
+	for i := 0; i < maxReferrals; i++ {
+		extra := make([]string, 0)
+		for _, ns := range r.NS {
+			if !checked[ns] {
+				extra = append(extra, ns)
+				checked[ns] = true
+			}
+		}
+		if len(extra) == 0 {
+			break
+		}
+		childOnly, err := queryNSParallel(q.Domain, extra)
+		if err != nil {
+			finding("ERROR querying child-only nameservers: %s %s", q.Domain, err)
+			break
+		}
+		for server, result := range childOnly.Results {
+			result.ChildOnly = true
+			r.Results[server] = result
+			for addr, a := range result.Addrs {
+				if kind, _ := classifyLame(a, r.Domain); kind == "" && !StringArrayEquals(a.NS, authNS) {
+					finding("unexpected difference in nameservers (child-only): %q @%s expected %d: %v, got %d: %v",
+						r.Domain, serverAddr(server, addr), len(authNS), authNS, len(a.NS), a.NS)
+				}
+			}
+		}
+		r.NS = r.allNS()
+	}
+}
+
+// kinds of lame responses, used in findings
+const (
+	lameNoAddress        = "no address"
+	lameUnreachable      = "unreachable"
+	lameRefused          = "REFUSED"
+	lameServFail         = "SERVFAIL"
+	lameNXDomain         = "NXDOMAIN"
+	lameRcode            = "rcode"
+	lameUpwardReferral   = "upward referral"
+	lameReferral         = "referral"
+	lameNotAuthoritative = "not authoritative"
+	lameNoNS             = "no NS in answer"
+)
+
+// classifyLame returns the kind of lameness of a single response to the NS query for domain and a description of it,
+// kind is empty if the response is a proper authoritative answer
+func classifyLame(r *queryResult, domain string) (string, string) {
+	switch {
+	case r.Err != nil:
+		return lameUnreachable, r.Err.Error()
+	case r.Rcode == dns.RcodeRefused:
+		return lameRefused, "server refused the query"
+	case r.Rcode == dns.RcodeServerFailure:
+		return lameServFail, "server failed to answer the query"
+	case r.Rcode == dns.RcodeNameError:
+		return lameNXDomain, "server says the name does not exist"
+	case r.Rcode != dns.RcodeSuccess:
+		return lameRcode, fmt.Sprintf("server answered with rcode %s", dns.RcodeToString[r.Rcode])
+	case !r.Authoritative && r.NSSection == sectionAuthority && r.NSOwner != domain && dns.IsSubDomain(dns.Fqdn(r.NSOwner), dns.Fqdn(domain)):
+		return lameUpwardReferral, fmt.Sprintf("referred up to %q NS %v", dns.Fqdn(r.NSOwner), r.NS)
+	case !r.Authoritative && r.NSSection == sectionAuthority:
+		return lameReferral, fmt.Sprintf("referred to %q NS %v", dns.Fqdn(r.NSOwner), r.NS)
+	case !r.Authoritative:
+		return lameNotAuthoritative, "AA bit not set"
+	case r.NSSection != sectionAnswer:
+		return lameNoNS, "authoritative answer without NS records"
+	}
+	return "", ""
+}
+
+// checkTCP sends the NS query to every authoritative address again over TCP and compares it with the UDP answer
+func checkTCP(r *queryGroup) uint {
+	var found uint = 0
+	for server := range r.Results {
+		udpResults := r.Results[server].Addrs
+		addrs := r.Results[server].sortedAddrs()
+		tcpResults := make([]*queryResult, len(addrs))
+		var g errgroup.Group
+		for i, addr := range addrs {
+			i, addr := i, addr
+			g.Go(func() error {
+				tcpResults[i] = queryNSServer(server, net.ParseIP(addr), r.Domain, transportTCP)
+				return nil
+			})
+		}
+		g.Wait()
+
+		for i, addr := range addrs {
+			udp, tcp := udpResults[addr], tcpResults[i]
+			udp.setTransport(transportTCP, tcp)
+			if tcp.Err != nil {
+				finding("TCP failure: %q @%s: %s", r.Domain, serverAddr(server, addr), tcp.Err)
+				found++
+				continue
+			}
+			if udp.Err != nil {
+				// nothing to compare against, the UDP error is reported by other checks
+				continue
+			}
+			if udp.Authoritative != tcp.Authoritative || !StringArrayEquals(udp.NS, tcp.NS) {
+				finding("TCP response differs: %q @%s: UDP AA: %t NS: %v, TCP AA: %t NS: %v", r.Domain, serverAddr(server, addr), udp.Authoritative, udp.NS, tcp.Authoritative, tcp.NS)
+				found++
+			}
+		}
+	}
+	return found
 }
 
 // TODO this can be made more efficient, lots of redundant checks
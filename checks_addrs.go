@@ -0,0 +1,183 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"sort"
+	"strings"
+)
+
+// addrRange is a named range nameserver addresses should not be in
+type addrRange struct {
+	Net  *net.IPNet
+	Name string
+}
+
+// specialRanges are the ranges from the IANA IPv4 and IPv6 special-purpose address registries that are not globally
+// reachable, plus multicast, RFC 6890. IPv4-mapped IPv6 addresses are parsed as IPv4 and checked against the IPv4 ranges.
+var specialRanges = mustParseRanges(map[string]string{
+	"0.0.0.0/8":          "This network",
+	"10.0.0.0/8":         "Private-Use",
+	"100.64.0.0/10":      "Shared Address Space",
+	"127.0.0.0/8":        "Loopback",
+	"169.254.0.0/16":     "Link Local",
+	"172.16.0.0/12":      "Private-Use",
+	"192.0.0.0/24":       "IETF Protocol Assignments",
+	"192.0.2.0/24":       "Documentation (TEST-NET-1)",
+	"192.88.99.0/24":     "Deprecated 6to4 Relay Anycast",
+	"192.168.0.0/16":     "Private-Use",
+	"198.18.0.0/15":      "Benchmarking",
+	"198.51.100.0/24":    "Documentation (TEST-NET-2)",
+	"203.0.113.0/24":     "Documentation (TEST-NET-3)",
+	"224.0.0.0/4":        "Multicast",
+	"240.0.0.0/4":        "Reserved",
+	"255.255.255.255/32": "Limited Broadcast",
+	"::/128":             "Unspecified Address",
+	"::1/128":            "Loopback Address",
+	"64:ff9b:1::/48":     "IPv4-IPv6 Translation",
+	"100::/64":           "Discard-Only Address Block",
+	"2001::/23":          "IETF Protocol Assignments",
+	"2001:2::/48":        "Benchmarking",
+	"2001:10::/28":       "Deprecated ORCHID",
+	"2001:db8::/32":      "Documentation",
+	"2002::/16":          "6to4",
+	"3fff::/20":          "Documentation",
+	"5f00::/16":          "Segment Routing (SRv6) SIDs",
+	"fc00::/7":           "Unique-Local",
+	"fe80::/10":          "Link-Local Unicast",
+	"ff00::/8":           "Multicast",
+})
+
+// globalRanges are the globally reachable assignments inside the special-purpose ranges, which are not reported
+var globalRanges = mustParseRanges(map[string]string{
+	"192.0.0.9/32":    "Port Control Protocol Anycast",
+	"192.0.0.10/32":   "Traversal Using Relays around NAT Anycast",
+	"2001:1::1/128":   "Port Control Protocol Anycast",
+	"2001:1::2/128":   "Traversal Using Relays around NAT Anycast",
+	"2001:1::3/128":   "DNS-SD Service Registration Protocol Anycast",
+	"2001:3::/32":     "AMT",
+	"2001:4:112::/48": "AS112-v6",
+	"2001:20::/28":    "ORCHIDv2",
+	"2001:30::/28":    "Drone Remote ID Protocol Entity Tags (DETs) Prefix",
+})
+
+// deniedRanges are extra ranges from -deny-cidrs, and allowedRanges are exempt from the check, for private roots
+var (
+	deniedRanges  []addrRange
+	allowedRanges []addrRange
+)
+
+func mustParseRanges(ranges map[string]string) []addrRange {
+	out := make([]addrRange, 0, len(ranges))
+	for cidr, name := range ranges {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		check(err)
+		out = append(out, addrRange{Net: ipNet, Name: name})
+	}
+	// the most specific range comes first so that it names the addresses it covers, ex: 2001:db8::/32 inside 2001::/23
+	sort.Slice(out, func(i, j int) bool {
+		si, _ := out[i].Net.Mask.Size()
+		sj, _ := out[j].Net.Mask.Size()
+		if si != sj {
+			return si > sj
+		}
+		return out[i].Net.String() < out[j].Net.String()
+	})
+	return out
+}
+
+// parseCIDRs parses a comma-separated list of CIDRs, all named name
+func parseCIDRs(list, name string) ([]addrRange, error) {
+	var out []addrRange
+	for _, cidr := range strings.Split(list, ",") {
+		if cidr == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, addrRange{Net: ipNet, Name: name})
+	}
+	return out, nil
+}
+
+// addrRangeOf returns the denied or special-purpose range ip is in, or nil if it is not in any, is allowed, or is a
+// globally reachable assignment inside a special-purpose range
+func addrRangeOf(ip net.IP) *addrRange {
+	for _, r := range allowedRanges {
+		if r.Net.Contains(ip) {
+			return nil
+		}
+	}
+	for i := range deniedRanges {
+		if deniedRanges[i].Net.Contains(ip) {
+			return &deniedRanges[i]
+		}
+	}
+	for _, r := range globalRanges {
+		if r.Net.Contains(ip) {
+			return nil
+		}
+	}
+	for i := range specialRanges {
+		if specialRanges[i].Net.Contains(ip) {
+			return &specialRanges[i]
+		}
+	}
+	return nil
+}
+
+// checkNSAddrs checks every nameserver address of the zone, from the glue in parent and the addresses queried in auth,
+// against the special-purpose and denied ranges
+func checkNSAddrs(parent, auth *queryGroup) uint {
+	var found uint = 0
+	type source struct {
+		host, addr string
+	}
+	// where each address was learned from
+	sources := make(map[source]string)
+	glue, _ := parentGlue(parent)
+	for host, ips := range glue {
+		for _, ip := range ips {
+			sources[source{host, ip.String()}] = "glue"
+		}
+	}
+	if auth != nil {
+		for host, result := range auth.Results {
+			for addr := range result.Addrs {
+				if _, ok := sources[source{host, addr}]; !ok {
+					sources[source{host, addr}] = "resolved"
+				}
+			}
+		}
+	}
+
+	keys := make([]source, 0, len(sources))
+	for s := range sources {
+		keys = append(keys, s)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].host < keys[j].host || (keys[i].host == keys[j].host && keys[i].addr < keys[j].addr)
+	})
+	for _, s := range keys {
+		if r := addrRangeOf(net.ParseIP(s.addr)); r != nil {
+			finding("special-purpose NS address: %q NS %s is in %s (%s), from %s", parent.Domain, serverAddr(s.host, s.addr), r.Net, r.Name, sources[s])
+			found++
+		}
+	}
+	return found
+}
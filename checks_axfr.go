@@ -0,0 +1,194 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// results of a zone transfer attempt
+const (
+	axfrOpen    = "open"
+	axfrRefused = "refused"
+	axfrTimeout = "timeout"
+	axfrError   = "error"
+)
+
+// stop reading a transfer after this many records, the zone is exposed either way
+const axfrMaxRecords = 1000000
+
+// axfrDir is the directory open zone transfers are saved to, they are not saved if empty
+var axfrDir = ""
+
+type axfrResult struct {
+	Status   string
+	Rcode    int
+	Records  int  // records received, including both SOA records
+	Complete bool // the transfer ended with the closing SOA record
+	Err      error
+}
+
+// transferZone tries an AXFR of zone from a single nameserver address, counting the records and writing them to w if it is not nil
+func transferZone(server string, ip net.IP, zone string, w io.Writer) *axfrResult {
+	if err := health.Allow(server, ip.String(), transportTCP); err != nil {
+		return &axfrResult{Status: axfrTimeout, Err: err}
+	}
+	limits.Wait(server, ip)
+	m := new(dns.Msg)
+	m.SetAxfr(dns.Fqdn(zone))
+
+	out := &axfrResult{}
+	err := func() error {
+		conn, err := client(transportTCP, ip).Dial(net.JoinHostPort(ip.String(), dnsPort))
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetWriteDeadline(time.Now().Add(clientCfg.ReadTimeout))
+		if err := conn.WriteMsg(m); err != nil {
+			return err
+		}
+		soas := 0
+		for out.Records < axfrMaxRecords {
+			conn.SetReadDeadline(time.Now().Add(clientCfg.ReadTimeout))
+			in, err := conn.ReadMsg()
+			if err != nil {
+				return err
+			}
+			if in.Id != m.Id {
+				return dns.ErrId
+			}
+			if in.Rcode != dns.RcodeSuccess {
+				out.Rcode = in.Rcode
+				return nil
+			}
+			for _, rr := range in.Answer {
+				if out.Records == 0 && rr.Header().Rrtype != dns.TypeSOA {
+					return fmt.Errorf("transfer does not start with SOA")
+				}
+				out.Records++
+				if w != nil {
+					fmt.Fprintln(w, rr.String())
+				}
+				if rr.Header().Rrtype == dns.TypeSOA {
+					soas++
+				}
+			}
+			if soas >= 2 || (out.Records == 0 && len(in.Answer) == 0) {
+				out.Complete = soas >= 2
+				return nil
+			}
+		}
+		return nil
+	}()
+	health.Record(server, ip.String(), transportTCP, err)
+
+	var netErr net.Error
+	switch {
+	case out.Records > 0:
+		out.Status = axfrOpen
+		out.Err = err
+	case err == nil:
+		out.Status = axfrRefused
+	case errors.As(err, &netErr) && netErr.Timeout():
+		out.Status, out.Err = axfrTimeout, err
+	default:
+		out.Status, out.Err = axfrError, err
+	}
+	return out
+}
+
+// transferAndSave runs transferZone, saving the records to axfrDir if it is set
+func transferAndSave(server string, ip net.IP, zone string) *axfrResult {
+	if axfrDir == "" {
+		return transferZone(server, ip, zone, nil)
+	}
+	path := filepath.Join(axfrDir, fmt.Sprintf("%s@%s.zone", cleanDomain(zone), ip))
+	file, err := os.Create(path)
+	if err != nil {
+		return &axfrResult{Status: axfrError, Err: err}
+	}
+	w := bufio.NewWriter(file)
+	result := transferZone(server, ip, zone, w)
+	w.Flush()
+	file.Close()
+	if result.Status != axfrOpen {
+		os.Remove(path)
+	}
+	return result
+}
+
+// reportAXFR logs a finding for an open transfer, and returns 1 if there was one
+func reportAXFR(zone, server, addr, kind string, result *axfrResult) uint {
+	switch result.Status {
+	case axfrOpen:
+		count := fmt.Sprintf("%d", result.Records)
+		if !result.Complete {
+			count = "at least " + count
+		}
+		finding("open zone transfer: %q%s allows AXFR of %q, %s records leaked", serverAddr(server, addr), kind, zone, count)
+		return 1
+	case axfrRefused:
+		v("AXFR of %q @%s%s refused: %s", zone, serverAddr(server, addr), kind, dns.RcodeToString[result.Rcode])
+	default:
+		v("AXFR of %q @%s%s %s: %v", zone, serverAddr(server, addr), kind, result.Status, result.Err)
+	}
+	return 0
+}
+
+// checkAXFR tries a zone transfer from every authoritative address in r, and from the SOA MNAME if it is not one of them
+func checkAXFR(r *queryGroup) uint {
+	var found uint = 0
+	outputs := forEachAnsweringAddr(r, func(server string, ip net.IP) *axfrResult {
+		result := transferAndSave(server, ip, r.Domain)
+		r.Results[server].Addrs[ip.String()].AXFR = result
+		return result
+	})
+	mnames := make(map[string]bool)
+	for _, o := range outputs {
+		found += reportAXFR(r.Domain, o.Server, o.Addr, "", o.Out)
+		if soa := r.Results[o.Server].Addrs[o.Addr].SOA; soa != nil {
+			mnames[cleanDomain(soa.Ns)] = true
+		}
+	}
+
+	// hidden primaries
+	hosts := stringMapToArrayKeys(mnames)
+	sort.Strings(hosts)
+	for _, mname := range hosts {
+		if _, ok := r.Results[mname]; ok || mname == "" {
+			continue
+		}
+		ips, err := resolveNS(mname)
+		if err != nil {
+			v("AXFR of %q from MNAME %q: %s", r.Domain, mname, err)
+			continue
+		}
+		for _, ip := range ips {
+			found += reportAXFR(r.Domain, mname, ip.String(), " (SOA MNAME)", transferAndSave(mname, ip, r.Domain))
+		}
+	}
+	return found
+}
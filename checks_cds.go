@@ -0,0 +1,225 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// cdsState is what a single nameserver address publishes for automated DS maintenance, RFC 7344 and RFC 8078
+type cdsState struct {
+	CDS          string // rdata of the CDS set, for comparing between servers
+	CDNSKEY      string // rdata of the CDNSKEY set, for comparing between servers
+	DeleteSignal bool   // the server asks the parent to remove the DS
+	Problems     []string
+}
+
+// isDeleteCDS is true for the CDS that asks the parent to remove the DS, CDS 0 0 0 00
+func isDeleteCDS(cds *dns.CDS) bool {
+	return cds.KeyTag == 0 && cds.Algorithm == 0 && cds.DigestType == 0 && strings.Trim(cds.Digest, "0") == ""
+}
+
+// isDeleteCDNSKEY is true for the CDNSKEY that asks the parent to remove the DS, CDNSKEY 0 3 0 AA==
+func isDeleteCDNSKEY(key *dns.CDNSKEY) bool {
+	return key.Flags == 0 && key.Protocol == 3 && key.Algorithm == 0 && key.PublicKey == "AA=="
+}
+
+// rdataSet formats the rdata of a set of records, sorted, for comparing between servers
+func rdataSet(rrs []dns.RR) string {
+	out := make([]string, 0, len(rrs))
+	for _, rr := range rrs {
+		out = append(out, strings.TrimPrefix(rr.String(), rr.Header().String()))
+	}
+	sort.Strings(out)
+	return strings.Join(out, ", ")
+}
+
+// sameKey is true if the CDNSKEY publishes the DNSKEY
+func sameKey(c *dns.CDNSKEY, k *dns.DNSKEY) bool {
+	return c.Flags == k.Flags && c.Protocol == k.Protocol && c.Algorithm == k.Algorithm && c.PublicKey == k.PublicKey
+}
+
+// queryCDS fetches the CDS and CDNSKEY sets from a single nameserver address, and checks them against the DNSKEY set
+func queryCDS(server string, ip net.IP, zone string, dnskeys []*dns.DNSKEY, now time.Time) (*cdsState, error) {
+	cdsRRs, cdsSigs, err := queryDNSSEC(server, ip, zone, dns.TypeCDS)
+	if err != nil {
+		return nil, err
+	}
+	cdnskeyRRs, cdnskeySigs, err := queryDNSSEC(server, ip, zone, dns.TypeCDNSKEY)
+	if err != nil {
+		return nil, err
+	}
+	if len(cdsRRs)+len(cdnskeyRRs) == 0 {
+		return &cdsState{}, nil
+	}
+	if dnskeys == nil {
+		rrs, _, err := queryDNSSEC(server, ip, zone, dns.TypeDNSKEY)
+		if err != nil {
+			return nil, err
+		}
+		for _, rr := range rrs {
+			dnskeys = append(dnskeys, rr.(*dns.DNSKEY))
+		}
+	}
+
+	state := &cdsState{CDS: rdataSet(cdsRRs), CDNSKEY: rdataSet(cdnskeyRRs)}
+	var cdss []*dns.CDS
+	var cdnskeys []*dns.CDNSKEY
+	deletes := 0
+	for _, rr := range cdsRRs {
+		cds := rr.(*dns.CDS)
+		cdss = append(cdss, cds)
+		if isDeleteCDS(cds) {
+			deletes++
+		} else if _, problems := dsKeys([]*dns.DS{&cds.DS}, dnskeys); len(problems) > 0 {
+			state.Problems = append(state.Problems, "CDS does not match the DNSKEY set: "+problems[0])
+		}
+	}
+	for _, rr := range cdnskeyRRs {
+		key := rr.(*dns.CDNSKEY)
+		cdnskeys = append(cdnskeys, key)
+		if isDeleteCDNSKEY(key) {
+			deletes++
+			continue
+		}
+		published := false
+		for _, k := range dnskeys {
+			published = published || sameKey(key, k)
+		}
+		if !published {
+			state.Problems = append(state.Problems, fmt.Sprintf("CDNSKEY with key tag %d is not in the DNSKEY set", key.KeyTag()))
+		}
+	}
+	state.DeleteSignal = deletes > 0
+	if deletes > 0 && deletes != len(cdsRRs)+len(cdnskeyRRs) {
+		state.Problems = append(state.Problems, "delete signal published next to other CDS or CDNSKEY records")
+	}
+
+	// the CDS and CDNSKEY sets have to describe the same keys when both are published, a key can have a CDS for
+	// each digest type so the records are matched by key and not counted
+	if len(cdss) > 0 && len(cdnskeys) > 0 && !state.DeleteSignal {
+		keys := make([]*dns.DNSKEY, 0, len(cdnskeys))
+		for _, key := range cdnskeys {
+			keys = append(keys, &key.DNSKEY)
+		}
+		dss := make([]*dns.DS, 0, len(cdss))
+		for _, cds := range cdss {
+			dss = append(dss, &cds.DS)
+			if matched, _ := dsKeys([]*dns.DS{&cds.DS}, keys); len(matched) == 0 {
+				state.Problems = append(state.Problems, fmt.Sprintf("CDS with key tag %d has no matching CDNSKEY", cds.KeyTag))
+			}
+		}
+		for _, key := range keys {
+			if matched, _ := dsKeys(dss, []*dns.DNSKEY{key}); len(matched) == 0 {
+				state.Problems = append(state.Problems, fmt.Sprintf("CDNSKEY with key tag %d has no matching CDS", key.KeyTag()))
+			}
+		}
+	}
+
+	// the parent only accepts sets signed by the zone's keys
+	for _, set := range []struct {
+		name string
+		rrs  []dns.RR
+		sigs []*dns.RRSIG
+	}{{"CDS", cdsRRs, cdsSigs}, {"CDNSKEY", cdnskeyRRs, cdnskeySigs}} {
+		if len(set.rrs) == 0 {
+			continue
+		}
+		if problem := sigProblem(set.rrs, set.sigs, dnskeys, now); problem != "" {
+			state.Problems = append(state.Problems, fmt.Sprintf("%s not signed: %s", set.name, problem))
+		}
+	}
+	return state, nil
+}
+
+// checkCDS queries the CDS and CDNSKEY sets from every authoritative address in r, and checks that they are the same on
+// every server, match the DNSKEY set and are signed, so that the parent would accept them
+func checkCDS(r *queryGroup) uint {
+	var found uint = 0
+	now := time.Now()
+	outputs := forEachAnsweringAddr(r, func(server string, ip net.IP) *cdsState {
+		result := r.Results[server].Addrs[ip.String()]
+		if kind, _ := classifyLame(result, r.Domain); kind != "" {
+			return nil
+		}
+		state, err := queryCDS(server, ip, r.Domain, result.DNSKEY, now)
+		if err != nil {
+			v("checkCDS(%q) @%s error: %s", r.Domain, serverAddr(server, ip.String()), err)
+			return nil
+		}
+		return state
+	})
+
+	cdsSets := make(map[string][]string)
+	cdnskeySets := make(map[string][]string)
+	problems := make(map[string][]string)
+	published, deletes := 0, 0
+	for _, o := range outputs {
+		if o.Out == nil {
+			continue
+		}
+		addr := serverAddr(o.Server, o.Addr)
+		cdsSets[o.Out.CDS] = append(cdsSets[o.Out.CDS], addr)
+		cdnskeySets[o.Out.CDNSKEY] = append(cdnskeySets[o.Out.CDNSKEY], addr)
+		for _, problem := range o.Out.Problems {
+			problems[problem] = append(problems[problem], addr)
+		}
+		if o.Out.CDS != "" || o.Out.CDNSKEY != "" {
+			published++
+		}
+		if o.Out.DeleteSignal {
+			deletes++
+		}
+	}
+	if published == 0 {
+		return found
+	}
+
+	for _, sets := range []struct {
+		name string
+		sets map[string][]string
+	}{{"CDS", cdsSets}, {"CDNSKEY", cdnskeySets}} {
+		if len(sets.sets) > 1 {
+			variants := make([]string, 0, len(sets.sets))
+			for _, set := range sortedKeys(sets.sets) {
+				label := set
+				if label == "" {
+					label = "none"
+				}
+				variants = append(variants, fmt.Sprintf("[%s] from %v", label, sets.sets[set]))
+			}
+			finding("%s differs between servers: %q, the parent will not update the DS: %v", sets.name, r.Domain, variants)
+			found++
+		}
+	}
+	for _, problem := range sortedKeys(problems) {
+		finding("CDS/CDNSKEY problem: %q: %s from %v", r.Domain, problem, problems[problem])
+		found++
+	}
+	if deletes > 0 {
+		finding("CDS delete signal: %q asks the parent to remove the DS from %d of %d servers", r.Domain, deletes, published)
+		found++
+	}
+	if found == 0 {
+		v("CDS/CDNSKEY for %q are consistent on every server and ready for the parent", r.Domain)
+	}
+	return found
+}
@@ -0,0 +1,242 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"lame-dns/cache"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/errgroup"
+)
+
+// zone cuts above every nameserver host from the TLD down, keyed by nameserver
+var nsHostZones = cache.New[[]string]()
+
+// hostZoneCuts follows referrals for host from the closest zone cut already recorded above it, recording every delegation
+// on the way, and returns the zone cuts above host from the TLD down. Resolving host needs every one of them.
+func hostZoneCuts(host string) []string {
+	labels := SplitDomainNameWithParent(host)
+	servers := rootServers
+	var zones []string
+	for i := len(labels) - 1; i >= 0; i-- {
+		if d, ok := deps.Delegation(labels[i]); ok {
+			zones = append(zones, labels[i])
+			servers = d.Hosts
+		}
+	}
+
+	name := dns.Fqdn(host)
+	for i := 0; i < maxReferrals; i++ {
+		in, err := queryAny(servers, name, dns.TypeA, 0)
+		if err != nil {
+			// the servers of the last zone can not be reached, which is all a cycle needs to know
+			v("hostZoneCuts(%q) error: %s", host, err)
+			break
+		}
+		if in.Rcode != dns.RcodeSuccess || len(in.Answer) > 0 || in.Authoritative {
+			break
+		}
+
+		// referral
+		zone := ""
+		next := make([]string, 0, len(in.Ns))
+		for _, r := range in.Ns {
+			if t, ok := r.(*dns.NS); ok && dns.IsSubDomain(t.Hdr.Name, name) {
+				zone = cleanDomain(t.Hdr.Name)
+				next = append(next, cleanDomain(t.Ns))
+			}
+		}
+		if len(next) == 0 || zone == "" || (len(zones) > 0 && dns.CountLabel(zone) <= dns.CountLabel(zones[len(zones)-1])) {
+			// no referral, or an upward one
+			break
+		}
+		glue := make(map[string]bool)
+		for h := range glueAddrs(in, next) {
+			glue[h] = true
+		}
+		deps.AddDelegation(zone, next, glue)
+		addGlue(in, next)
+		zones = append(zones, zone)
+		servers = next
+	}
+	return zones
+}
+
+// walkNSHostZones finds the zone cuts above every nameserver host the first time it is seen, for reportNSCycles
+func walkNSHostZones(hosts []string) {
+	var g errgroup.Group
+	for _, host := range hosts {
+		host := host
+		if isIPHost(host) {
+			continue
+		}
+		addFun, first := nsHostZones.AddCheck(host)
+		if !first {
+			continue
+		}
+		g.Go(func() error {
+			addFun(hostZoneCuts(host), nil)
+			return nil
+		})
+	}
+	g.Wait()
+}
+
+// nsCycle is a loop of zones that can only be resolved through each other, Hosts[i] is the nameserver of Zones[i]
+// that needs Zones[i+1]
+type nsCycle struct {
+	Zones    []string
+	Hosts    []string
+	Affected []string // every zone that can not be resolved because of the cycle
+}
+
+func (c nsCycle) String() string {
+	var b strings.Builder
+	for i := range c.Zones {
+		fmt.Fprintf(&b, "%s NS %s -> ", c.Zones[i], c.Hosts[i])
+	}
+	b.WriteString(c.Zones[0])
+	return b.String()
+}
+
+// stuckOn returns the first zone cut above host that is not known to resolve, or "" if host can be resolved with the
+// glue in the referral d, or its zone cuts are unknown
+func stuckOn(d delegation, host string, zones map[string]delegation, resolvable map[string]bool, hostZones func(string) ([]string, bool)) string {
+	if d.Glue[host] {
+		return ""
+	}
+	cuts, ok := hostZones(host)
+	if !ok {
+		return ""
+	}
+	for _, zone := range cuts {
+		if _, known := zones[zone]; known && !resolvable[zone] {
+			return zone
+		}
+	}
+	return ""
+}
+
+// findNSCycles returns the cycles that leave zones unresolvable from the root. A zone resolves when any of its nameserver
+// hosts has glue in the referral, or every zone cut above the host resolves.
+func findNSCycles(zones map[string]delegation, hostZones func(string) ([]string, bool)) []nsCycle {
+	resolvable := make(map[string]bool)
+	for changed := true; changed; {
+		changed = false
+		for zone, d := range zones {
+			if resolvable[zone] {
+				continue
+			}
+			for _, host := range d.Hosts {
+				if stuckOn(d, host, zones, resolvable, hostZones) == "" {
+					resolvable[zone] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	var unresolvable []string
+	for zone := range zones {
+		if !resolvable[zone] {
+			unresolvable = append(unresolvable, zone)
+		}
+	}
+	sort.Strings(unresolvable)
+
+	// every host of an unresolvable zone is stuck on another unresolvable zone, so following the first one always loops
+	cycles := make(map[string]*nsCycle)
+	var keys []string
+	for _, start := range unresolvable {
+		var path, hosts []string
+		index := make(map[string]int)
+		zone := start
+		for {
+			if _, ok := index[zone]; ok {
+				break
+			}
+			index[zone] = len(path)
+			d := zones[zone]
+			sorted := append([]string(nil), d.Hosts...)
+			sort.Strings(sorted)
+			next, host := "", ""
+			for _, h := range sorted {
+				if next = stuckOn(d, h, zones, resolvable, hostZones); next != "" {
+					host = h
+					break
+				}
+			}
+			path = append(path, zone)
+			hosts = append(hosts, host)
+			zone = next
+		}
+
+		// rotate the loop to start at its first zone so it is only reported once
+		loop, loopHosts := path[index[zone]:], hosts[index[zone]:]
+		first := 0
+		for i := range loop {
+			if loop[i] < loop[first] {
+				first = i
+			}
+		}
+		c := nsCycle{
+			Zones: append(append([]string(nil), loop[first:]...), loop[:first]...),
+			Hosts: append(append([]string(nil), loopHosts[first:]...), loopHosts[:first]...),
+		}
+		key := c.String()
+		if cycles[key] == nil {
+			cycles[key] = &c
+			keys = append(keys, key)
+		}
+		for _, z := range path {
+			if !StringArrayToMap(cycles[key].Affected)[z] {
+				cycles[key].Affected = append(cycles[key].Affected, z)
+			}
+		}
+	}
+
+	sort.Strings(keys)
+	out := make([]nsCycle, 0, len(keys))
+	for _, key := range keys {
+		sort.Strings(cycles[key].Affected)
+		out = append(out, *cycles[key])
+	}
+	return out
+}
+
+// reportNSCycles logs a finding for every cycle of zones whose nameservers can only be resolved through each other,
+// with every input name walked through an affected zone or using a nameserver in the cycle
+func reportNSCycles() {
+	for _, c := range findNSCycles(deps.Delegations(), nsHostZones.Get) {
+		exposed := make(map[string]bool)
+		for _, zone := range c.Affected {
+			for _, name := range deps.InputsThrough(zone) {
+				exposed[name] = true
+			}
+		}
+		for _, host := range c.Hosts {
+			for _, name := range deps.InputsUsing(host) {
+				exposed[name] = true
+			}
+		}
+		inputs := stringMapToArrayKeys(exposed)
+		sort.Strings(inputs)
+		finding("cyclic NS dependency: %s without glue, %v can not be resolved, used by %d domains: %v", c, c.Affected, len(inputs), inputs)
+	}
+}
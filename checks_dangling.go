@@ -0,0 +1,138 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"lame-dns/cache"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/errgroup"
+)
+
+// results of resolving a nameserver host on its own
+const (
+	hostOK       = ""
+	hostNXDomain = "NXDOMAIN"
+	hostNoData   = "NODATA"
+	hostTimeout  = "timeout"
+	hostError    = "error"
+)
+
+type hostStatus struct {
+	Status string
+	Err    error
+}
+
+// Dangling is true when the host does not exist or has no addresses, which are both usually hijackable
+func (s hostStatus) Dangling() bool {
+	return s.Status == hostNXDomain || s.Status == hostNoData
+}
+
+var nsHostStatus = cache.New[hostStatus]()
+
+// problemHosts holds every nameserver host that could not be resolved, reported at the end of the run
+var problemHosts = struct {
+	sync.Mutex
+	hosts map[string]hostStatus
+}{hosts: make(map[string]hostStatus)}
+
+// resolveHostStatus looks up the A and AAAA records of host, ignoring any glue, and classifies the result
+func resolveHostStatus(host string) hostStatus {
+	var status hostStatus
+	noData := 0
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		ips, err := resolveIterative(host, qtype, 0)
+		var netErr net.Error
+		switch {
+		case err == nil && len(ips) > 0:
+			return hostStatus{Status: hostOK}
+		case err == nil:
+			noData++
+		case errors.Is(err, errNXDomain):
+			// the name does not exist for any type
+			return hostStatus{Status: hostNXDomain, Err: err}
+		case errors.Is(err, errCircuitOpen) || (errors.As(err, &netErr) && netErr.Timeout()):
+			status = hostStatus{Status: hostTimeout, Err: err}
+		default:
+			if status.Status != hostTimeout {
+				status = hostStatus{Status: hostError, Err: err}
+			}
+		}
+	}
+	if noData == 2 {
+		return hostStatus{Status: hostNoData}
+	}
+	return status
+}
+
+// checkDanglingNS resolves every nameserver host on its own the first time it is seen, and returns the number of
+// hosts that were newly found to not resolve. The findings are reported by reportDanglingNS once every input name
+// depending on the host is known.
+func checkDanglingNS(hosts []string) uint {
+	var found uint = 0
+	var m sync.Mutex
+	var g errgroup.Group
+	for _, host := range hosts {
+		host := host
+		if isIPHost(host) {
+			continue
+		}
+		addFun, first := nsHostStatus.AddCheck(host)
+		if !first {
+			continue
+		}
+		g.Go(func() error {
+			status := resolveHostStatus(host)
+			addFun(status, nil)
+			if status.Status == hostOK {
+				return nil
+			}
+			v("nameserver host %q does not resolve (%s): %v", host, status.Status, status.Err)
+			problemHosts.Lock()
+			problemHosts.hosts[host] = status
+			problemHosts.Unlock()
+			m.Lock()
+			found++
+			m.Unlock()
+			return nil
+		})
+	}
+	g.Wait()
+	return found
+}
+
+// reportDanglingNS logs a finding for every nameserver host that did not resolve, with every input name that depends on it
+func reportDanglingNS() {
+	problemHosts.Lock()
+	defer problemHosts.Unlock()
+	hosts := make([]string, 0, len(problemHosts.hosts))
+	for host := range problemHosts.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		status := problemHosts.hosts[host]
+		inputs := deps.InputsUsing(host)
+		if status.Dangling() {
+			highFinding("dangling NS host (%s): %q is a nameserver for %d domains: %v", status.Status, host, len(inputs), inputs)
+		} else {
+			finding("unresolvable NS host (%s): %q is a nameserver for %d domains: %v: %v", status.Status, host, len(inputs), inputs, status.Err)
+		}
+	}
+}
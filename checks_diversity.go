@@ -0,0 +1,102 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+)
+
+// diversityPolicy holds the least redundancy expected of the nameservers of every zone, RFC 2182
+type diversityPolicy struct {
+	Hosts    uint // distinct nameserver hosts, and distinct addresses
+	Prefixes uint // distinct IPv4 /24 and IPv6 /48 networks
+	ASNs     uint // distinct origin ASNs, only checked when asns is loaded
+}
+
+var nsDiversity = diversityPolicy{Hosts: 2, Prefixes: 2, ASNs: 2}
+
+// networkPrefix returns the IPv4 /24 or IPv6 /48 containing ip
+func networkPrefix(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return fmt.Sprintf("%s/24", ip4.Mask(net.CIDRMask(24, 32)))
+	}
+	return fmt.Sprintf("%s/48", ip.Mask(net.CIDRMask(48, 128)))
+}
+
+// groupSummary formats the servers in every group, ex: [192.0.2.0/24: [ns1.example.net [192.0.2.7]]]
+func groupSummary(groups map[string][]string) []string {
+	out := make([]string, 0, len(groups))
+	for group, servers := range groups {
+		sort.Strings(servers)
+		out = append(out, fmt.Sprintf("%s: %v", group, servers))
+	}
+	sort.Strings(out)
+	return out
+}
+
+// checkDiversity counts the distinct nameserver hosts, addresses, networks and ASNs of the zone in r,
+// and reports any below nsDiversity
+func checkDiversity(r *queryGroup) uint {
+	var found uint = 0
+	if len(r.Results) == 0 {
+		// not a zone
+		return found
+	}
+
+	hosts := make([]string, 0, len(r.Results))
+	addrs := make(map[string]bool)
+	prefixes := make(map[string][]string)
+	origins := make(map[string][]string)
+	for host, result := range r.Results {
+		hosts = append(hosts, host)
+		for addr := range result.Addrs {
+			ip := net.ParseIP(addr)
+			addrs[addr] = true
+			prefix := networkPrefix(ip)
+			prefixes[prefix] = append(prefixes[prefix], serverAddr(host, addr))
+			if asns != nil {
+				asn := asns.Lookup(ip)
+				if asn == "" {
+					asn = "unknown"
+				} else {
+					asn = "AS" + asn
+				}
+				origins[asn] = append(origins[asn], serverAddr(host, addr))
+			}
+		}
+	}
+	sort.Strings(hosts)
+
+	if uint(len(hosts)) < nsDiversity.Hosts {
+		finding("too few nameservers: %q has %d nameserver hosts, want at least %d: %v", r.Domain, len(hosts), nsDiversity.Hosts, hosts)
+		found++
+	} else if uint(len(addrs)) < nsDiversity.Hosts {
+		addrList := stringMapToArrayKeys(addrs)
+		sort.Strings(addrList)
+		finding("too few nameserver addresses: %q has %d nameserver hosts on %d addresses, want at least %d: %v", r.Domain, len(hosts), len(addrs), nsDiversity.Hosts, addrList)
+		found++
+	}
+	if len(addrs) > 0 && uint(len(prefixes)) < nsDiversity.Prefixes {
+		finding("low network diversity: %q nameservers are in %d networks, want at least %d: %v", r.Domain, len(prefixes), nsDiversity.Prefixes, groupSummary(prefixes))
+		found++
+	}
+	if asns != nil && len(addrs) > 0 && uint(len(origins)) < nsDiversity.ASNs {
+		finding("low ASN diversity: %q nameservers are in %d ASNs, want at least %d: %v", r.Domain, len(origins), nsDiversity.ASNs, groupSummary(origins))
+		found++
+	}
+	return found
+}
@@ -0,0 +1,265 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"lame-dns/cache"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSKEYs of every zone whose DNSKEY set was validated from its DS, used to validate the DS sets of its children
+var zoneKeys = cache.New[[]*dns.DNSKEY]()
+
+// queryDNSSEC asks a single nameserver address for the qtype RRset of name with the DO bit set,
+// and returns the records of that type and their signatures from the answer
+func queryDNSSEC(server string, ip net.IP, name string, qtype uint16) ([]dns.RR, []*dns.RRSIG, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.RecursionDesired = false
+	size := clientCfg.UDPSize
+	if size == 0 {
+		size = dns.DefaultMsgSize
+	}
+	m.SetEdns0(size, true)
+
+	in, err := exchangeRetry(m, server, ip, transportUDP)
+	if err != nil {
+		return nil, nil, err
+	}
+	if in.Rcode != dns.RcodeSuccess {
+		return nil, nil, fmt.Errorf("rcode %s", dns.RcodeToString[in.Rcode])
+	}
+	if !in.Authoritative {
+		return nil, nil, fmt.Errorf("AA bit not set")
+	}
+	var rrs []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range in.Answer {
+		if cleanDomain(rr.Header().Name) != cleanDomain(name) {
+			continue
+		}
+		if sig, ok := rr.(*dns.RRSIG); ok && sig.TypeCovered == qtype {
+			sigs = append(sigs, sig)
+		} else if rr.Header().Rrtype == qtype {
+			rrs = append(rrs, rr)
+		}
+	}
+	return rrs, sigs, nil
+}
+
+// sigProblem returns why none of the signatures over rrset by one of the keys is valid at now, or "" if one is
+func sigProblem(rrset []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY, now time.Time) string {
+	problem := "no RRSIG by a trusted key"
+	for _, sig := range sigs {
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			switch {
+			case !sig.ValidityPeriod(now) && now.Before(time.Unix(int64(sig.Inception), 0)):
+				problem = fmt.Sprintf("RRSIG by key tag %d is not valid until %s", sig.KeyTag, dns.TimeToString(sig.Inception))
+			case !sig.ValidityPeriod(now):
+				problem = fmt.Sprintf("RRSIG by key tag %d expired at %s", sig.KeyTag, dns.TimeToString(sig.Expiration))
+			default:
+				if err := sig.Verify(key, rrset); err != nil {
+					problem = fmt.Sprintf("RRSIG by key tag %d does not verify: %s", sig.KeyTag, err)
+				} else {
+					return ""
+				}
+			}
+		}
+	}
+	return problem
+}
+
+// dsKeys returns the keys in the DNSKEY set that match one of the DS records, and a description of every DS that matched none
+func dsKeys(dss []*dns.DS, keys []*dns.DNSKEY) ([]*dns.DNSKEY, []string) {
+	var matched []*dns.DNSKEY
+	var problems []string
+	for _, ds := range dss {
+		problem := fmt.Sprintf("no DNSKEY with key tag %d algorithm %s", ds.KeyTag, dns.AlgorithmToString[ds.Algorithm])
+		if _, ok := dns.AlgorithmToString[ds.Algorithm]; !ok {
+			problem = fmt.Sprintf("DS key tag %d has unknown algorithm %d", ds.KeyTag, ds.Algorithm)
+		}
+		for _, key := range keys {
+			if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+				continue
+			}
+			digest := key.ToDS(ds.DigestType)
+			if digest == nil {
+				problem = fmt.Sprintf("DS key tag %d has unsupported digest type %d", ds.KeyTag, ds.DigestType)
+			} else if !strings.EqualFold(digest.Digest, ds.Digest) {
+				problem = fmt.Sprintf("DS key tag %d digest does not match the DNSKEY", ds.KeyTag)
+			} else {
+				problem = ""
+				matched = append(matched, key)
+				break
+			}
+		}
+		if problem != "" {
+			problems = append(problems, problem)
+		}
+	}
+	return matched, problems
+}
+
+// keySet formats the key tags and algorithms of a DNSKEY set for comparing and findings
+func keySet(keys []*dns.DNSKEY) string {
+	out := make([]string, 0, len(keys))
+	for _, key := range keys {
+		out = append(out, fmt.Sprintf("%d/%s", key.KeyTag(), dns.AlgorithmToString[key.Algorithm]))
+	}
+	sort.Strings(out)
+	return fmt.Sprintf("%v", out)
+}
+
+// checkDNSSEC fetches the DS set of the zone in auth from the parent servers in parent, and the DNSKEY set from every
+// authoritative address, and checks that the DS matches a key that signs the DNSKEY set on every server
+func checkDNSSEC(parent, auth *queryGroup) uint {
+	var found uint = 0
+	zone := auth.Domain
+	now := time.Now()
+
+	// DS from the first parent address that answers
+	var dss []*dns.DS
+	var dsRRs []dns.RR
+	var dsSigs []*dns.RRSIG
+	var dsErr error = fmt.Errorf("no parent servers answered")
+	servers := make([]string, 0, len(parent.Results))
+	for server := range parent.Results {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	for _, server := range servers {
+		for _, addr := range parent.Results[server].sortedAddrs() {
+			if dsErr == nil || parent.Results[server].Addrs[addr].Err != nil {
+				continue
+			}
+			dsRRs, dsSigs, dsErr = queryDNSSEC(server, net.ParseIP(addr), zone, dns.TypeDS)
+		}
+	}
+	if dsErr != nil {
+		v("checkDNSSEC(%q) DS error: %s", zone, dsErr)
+		return found
+	}
+	for _, rr := range dsRRs {
+		dss = append(dss, rr.(*dns.DS))
+	}
+	if len(dss) == 0 {
+		v("checkDNSSEC(%q) no DS, the delegation is not signed", zone)
+		return found
+	}
+
+	// the DS signature, if the keys of the parent are known
+	if len(dsSigs) > 0 {
+		if keys, ok := zoneKeys.Get(cleanDomain(dsSigs[0].SignerName)); ok && len(keys) > 0 {
+			if problem := sigProblem(dsRRs, dsSigs, keys, now); problem != "" {
+				finding("DNSSEC bad DS signature: %q DS in %q: %s", zone, cleanDomain(dsSigs[0].SignerName), problem)
+				found++
+			}
+		}
+	}
+
+	// DNSKEY from every authoritative address
+	type dnskeyOutput struct {
+		keys    []*dns.DNSKEY
+		problem string
+	}
+	outputs := forEachAnsweringAddr(auth, func(server string, ip net.IP) *dnskeyOutput {
+		result := auth.Results[server].Addrs[ip.String()]
+		if kind, _ := classifyLame(result, zone); kind != "" {
+			return nil
+		}
+		rrs, sigs, err := queryDNSSEC(server, ip, zone, dns.TypeDNSKEY)
+		if err != nil {
+			return &dnskeyOutput{problem: fmt.Sprintf("DNSKEY query failed: %s", err)}
+		}
+		out := &dnskeyOutput{}
+		for _, rr := range rrs {
+			out.keys = append(out.keys, rr.(*dns.DNSKEY))
+		}
+		result.DNSKEY = out.keys
+		if len(out.keys) == 0 {
+			out.problem = "no DNSKEY"
+			return out
+		}
+		matched, problems := dsKeys(dss, out.keys)
+		if len(matched) == 0 {
+			out.problem = fmt.Sprintf("no DNSKEY matches the DS: %s", strings.Join(problems, ", "))
+			return out
+		}
+		out.problem = sigProblem(rrs, sigs, matched, now)
+		return out
+	})
+
+	problems := make(map[string][]string)
+	sets := make(map[string][]string)
+	var validKeys []*dns.DNSKEY
+	for _, o := range outputs {
+		if o.Out == nil {
+			continue
+		}
+		if o.Out.problem != "" {
+			problems[o.Out.problem] = append(problems[o.Out.problem], serverAddr(o.Server, o.Addr))
+		} else if validKeys == nil {
+			validKeys = o.Out.keys
+		}
+		if len(o.Out.keys) > 0 {
+			set := keySet(o.Out.keys)
+			sets[set] = append(sets[set], serverAddr(o.Server, o.Addr))
+		}
+	}
+	for _, problem := range sortedKeys(problems) {
+		finding("DNSSEC validation failure: %q DS %v: %s from %v", zone, keyTags(dss), problem, problems[problem])
+		found++
+	}
+	if len(sets) > 1 {
+		variants := make([]string, 0, len(sets))
+		for _, set := range sortedKeys(sets) {
+			variants = append(variants, fmt.Sprintf("%s from %v", set, sets[set]))
+		}
+		finding("DNSSEC keys differ between servers: %q: %v", zone, variants)
+		found++
+	}
+	if validKeys != nil {
+		zoneKeys.Add(zone, validKeys)
+	}
+	return found
+}
+
+func keyTags(dss []*dns.DS) []uint16 {
+	out := make([]uint16, 0, len(dss))
+	for _, ds := range dss {
+		out = append(out, ds.KeyTag)
+	}
+	return out
+}
+
+// sortedKeys returns the keys of a map of server lists in order
+func sortedKeys(m map[string][]string) []string {
+	out := make([]string, 0, len(m))
+	for k := range m {
+		sort.Strings(m[k])
+		out = append(out, k)
+	}
+	sort.Strings(out)
+	return out
+}
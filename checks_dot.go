@@ -0,0 +1,121 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"lame-dns/cache"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// nameservers that advertise DNS over TLS with a dot SVCB record, keyed by nameserver
+var dotAdverts = cache.New[bool]()
+
+// dotProbeTimeout bounds the single query sent over DNS over TLS to nameservers that do not have to support it,
+// as most of them filter port 853 and would otherwise cost the full timeout on every retry
+var dotProbeTimeout = 2 * time.Second
+
+// expectedDoT are the domains whose nameservers are expected to support DNS over TLS
+var expectedDoT []string
+
+// dotAdvertised returns true if the nameserver advertises DNS over TLS in an SVCB record at _dns.<server>, RFC 9461
+func dotAdvertised(server string) bool {
+	addFun, first := dotAdverts.AddCheck(server)
+	if !first {
+		advertised, err := dotAdverts.GetWait(server)
+		return err == nil && advertised
+	}
+
+	advertised := false
+	in, err := lookup("_dns."+server, dns.TypeSVCB, 0)
+	if err != nil {
+		v("dotAdvertised(%q) error: %s", server, err)
+	}
+	if err == nil {
+		for _, rr := range in.Answer {
+			svcb, ok := rr.(*dns.SVCB)
+			if !ok {
+				continue
+			}
+			for _, kv := range svcb.Value {
+				if alpn, ok := kv.(*dns.SVCBAlpn); ok {
+					advertised = advertised || StringArrayToMap(alpn.Alpn)["dot"]
+				}
+			}
+		}
+	}
+	addFun(advertised, nil)
+	return advertised
+}
+
+// dotExpectation returns why the nameserver should support DNS over TLS, or "" if it does not have to
+func dotExpectation(server string) string {
+	for _, domain := range expectedDoT {
+		if dns.IsSubDomain(domain, server) {
+			return "expected"
+		}
+	}
+	if dotAdvertised(server) {
+		return "advertised"
+	}
+	return ""
+}
+
+// probeDoT sends m once over DNS over TLS, with timeouts of at most dotProbeTimeout
+func probeDoT(m *dns.Msg, server string, ip net.IP, transport string) (*dns.Msg, error) {
+	c := withServerName(client(transport, ip), server)
+	if c.DialTimeout > dotProbeTimeout {
+		c.DialTimeout = dotProbeTimeout
+	}
+	if c.ReadTimeout > dotProbeTimeout {
+		c.ReadTimeout = dotProbeTimeout
+	}
+	return sendQueryWith(c, m, server, ip, transport)
+}
+
+// checkDoT queries every authoritative nameserver address over DNS over TLS and compares it with the UDP answer.
+// Servers that are expected to support DNS over TLS get the usual retries, the others are only probed once.
+func checkDoT(r *queryGroup) uint {
+	var found uint = 0
+	outputs := forEachAnsweringAddr(r, func(server string, ip net.IP) *queryResult {
+		if dotExpectation(server) != "" {
+			return queryNSServer(server, ip, r.Domain, transportTLS)
+		}
+		return queryNSServerWith(server, ip, r.Domain, transportTLS, probeDoT)
+	})
+	for _, o := range outputs {
+		udp, tls := r.Results[o.Server].Addrs[o.Addr], o.Out
+		udp.setTransport(transportTLS, tls)
+		if tls.Err != nil {
+			if expectation := dotExpectation(o.Server); expectation != "" {
+				finding("DoT failure: %q @%s: DNS over TLS is %s: %s", r.Domain, serverAddr(o.Server, o.Addr), expectation, tls.Err)
+				found++
+			} else {
+				v("no DNS over TLS for %q @%s: %s", r.Domain, serverAddr(o.Server, o.Addr), tls.Err)
+			}
+			continue
+		}
+		if kind, detail := classifyLame(tls, r.Domain); kind != "" {
+			finding("DoT lame delegation (%s): %q for %q: %s", kind, serverAddr(o.Server, o.Addr), r.Domain, detail)
+			found++
+		} else if udp.Authoritative != tls.Authoritative || !StringArrayEquals(udp.NS, tls.NS) {
+			finding("DoT response differs: %q @%s: UDP AA: %t NS: %v, TLS AA: %t NS: %v", r.Domain, serverAddr(o.Server, o.Addr), udp.Authoritative, udp.NS, tls.Authoritative, tls.NS)
+			found++
+		}
+	}
+	return found
+}
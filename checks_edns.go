@@ -0,0 +1,190 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// option code used for the unknown option test, unassigned by IANA
+	ednsUnknownOption = 100
+	// flag used for the unknown flag test, the first undefined bit after DO
+	ednsUnknownFlag = 0x4000
+)
+
+// ednsTest is a single EDNS0 compliance test, modeled after https://ednscomp.isc.org
+type ednsTest struct {
+	name  string
+	qtype uint16
+	// edns adds EDNS0 to the query, nil sends a plain DNS query
+	edns func(opt *dns.OPT)
+	// check returns a description of what is wrong with the response, or "" if it passed
+	check func(in *dns.Msg) string
+}
+
+var ednsTests = []ednsTest{
+	{
+		name:  "plain DNS",
+		qtype: dns.TypeSOA,
+		check: func(in *dns.Msg) string {
+			if in.IsEdns0() != nil {
+				return "OPT record in response to a query without EDNS0"
+			}
+			return checkEDNSRcode(in, dns.RcodeSuccess)
+		},
+	},
+	{
+		name:  "EDNS",
+		qtype: dns.TypeSOA,
+		edns:  func(opt *dns.OPT) {},
+		check: func(in *dns.Msg) string {
+			return checkEDNSResponse(in, dns.RcodeSuccess)
+		},
+	},
+	{
+		name:  "unknown version",
+		qtype: dns.TypeSOA,
+		edns:  func(opt *dns.OPT) { opt.SetVersion(1) },
+		check: func(in *dns.Msg) string {
+			if problem := checkEDNSResponse(in, dns.RcodeBadVers); problem != "" {
+				return problem
+			}
+			if len(in.Answer) > 0 {
+				return "answer returned with BADVERS"
+			}
+			return ""
+		},
+	},
+	{
+		name:  "unknown option",
+		qtype: dns.TypeSOA,
+		edns: func(opt *dns.OPT) {
+			opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: ednsUnknownOption})
+		},
+		check: func(in *dns.Msg) string {
+			if problem := checkEDNSResponse(in, dns.RcodeSuccess); problem != "" {
+				return problem
+			}
+			for _, o := range in.IsEdns0().Option {
+				if o.Option() == ednsUnknownOption {
+					return "unknown option echoed back"
+				}
+			}
+			return ""
+		},
+	},
+	{
+		name:  "unknown flag",
+		qtype: dns.TypeSOA,
+		edns:  func(opt *dns.OPT) { opt.Hdr.Ttl |= ednsUnknownFlag },
+		check: func(in *dns.Msg) string {
+			if problem := checkEDNSResponse(in, dns.RcodeSuccess); problem != "" {
+				return problem
+			}
+			if in.IsEdns0().Hdr.Ttl&ednsUnknownFlag != 0 {
+				return "unknown flag echoed back"
+			}
+			return ""
+		},
+	},
+	{
+		name:  "DO bit",
+		qtype: dns.TypeSOA,
+		edns:  func(opt *dns.OPT) { opt.SetDo() },
+		check: func(in *dns.Msg) string {
+			if problem := checkEDNSResponse(in, dns.RcodeSuccess); problem != "" {
+				return problem
+			}
+			if !in.IsEdns0().Do() {
+				return "DO bit not echoed back"
+			}
+			return ""
+		},
+	},
+	{
+		name:  "small buffer",
+		qtype: dns.TypeDNSKEY,
+		edns: func(opt *dns.OPT) {
+			opt.SetUDPSize(dns.MinMsgSize)
+			opt.SetDo()
+		},
+		check: func(in *dns.Msg) string {
+			return checkEDNSResponse(in, dns.RcodeSuccess)
+		},
+	},
+}
+
+func checkEDNSRcode(in *dns.Msg, rcode int) string {
+	if in.Rcode != rcode {
+		return fmt.Sprintf("expected rcode %s, got %s", dns.RcodeToString[rcode], dns.RcodeToString[in.Rcode])
+	}
+	return ""
+}
+
+// checkEDNSResponse checks the parts every EDNS0 response must get right, an EDNS0 version 0 OPT record and the rcode
+func checkEDNSResponse(in *dns.Msg, rcode int) string {
+	opt := in.IsEdns0()
+	if opt == nil {
+		return "no OPT record in response"
+	}
+	if opt.Version() != 0 {
+		return fmt.Sprintf("OPT record with EDNS version %d", opt.Version())
+	}
+	return checkEDNSRcode(in, rcode)
+}
+
+// runEDNSTest sends a single EDNS0 compliance test query over UDP and returns any problem found in the answer.
+// The query is sent as is without the -udp-size EDNS0 settings, and retried like any other query, a server that
+// never answers is not counted as failing the test.
+func runEDNSTest(test ednsTest, server string, ip net.IP, domain string) string {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(domain), test.qtype)
+	m.RecursionDesired = false
+	if test.edns != nil {
+		m.SetEdns0(dns.DefaultMsgSize, false)
+		test.edns(m.IsEdns0())
+	}
+	in, err := retry(m, server, ip, transportUDP, sendQuery)
+	if err != nil {
+		v("EDNS test (%s) %q @%s: no answer: %s", test.name, domain, serverAddr(server, ip.String()), err)
+		return ""
+	}
+	return test.check(in)
+}
+
+// checkEDNS runs the EDNS0 compliance tests against every authoritative nameserver address
+func checkEDNS(r *queryGroup) uint {
+	var found uint = 0
+	outputs := forEachAnsweringAddr(r, func(server string, ip net.IP) []string {
+		problems := make([]string, len(ednsTests))
+		for i, test := range ednsTests {
+			problems[i] = runEDNSTest(test, server, ip, r.Domain)
+		}
+		return problems
+	})
+	for _, o := range outputs {
+		for i, problem := range o.Out {
+			if problem != "" {
+				finding("EDNS failure (%s): %q @%s: %s", ednsTests[i].name, r.Domain, serverAddr(o.Server, o.Addr), problem)
+				found++
+			}
+		}
+	}
+	return found
+}
@@ -0,0 +1,156 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// parentGlue returns the glue for each NS host from every referral in the parent results, and if there were any referrals
+func parentGlue(parent *queryGroup) (map[string][]net.IP, bool) {
+	out := make(map[string][]net.IP)
+	referral := false
+	for _, result := range parent.Results {
+		for _, r := range result.Addrs {
+			if r.Err != nil || r.Authoritative || r.NSSection != sectionAuthority {
+				continue
+			}
+			referral = true
+			for host, ips := range r.Glue {
+				for _, ip := range ips {
+					if !containsIP(out[host], ip) {
+						out[host] = append(out[host], ip)
+					}
+				}
+			}
+		}
+	}
+	return out, referral
+}
+
+// childAddrs asks every authoritative address in auth for the addresses of host, and returns all of them
+func childAddrs(auth *queryGroup, host string) []net.IP {
+	outs := forEachAnsweringAddr(auth, func(server string, ip net.IP) []net.IP {
+		if kind, _ := classifyLame(auth.Results[server].Addrs[ip.String()], auth.Domain); kind != "" {
+			return nil
+		}
+		var out []net.IP
+		for _, qtype := range queryQtypes() {
+			m := new(dns.Msg)
+			m.SetQuestion(dns.Fqdn(host), qtype)
+			m.RecursionDesired = false
+			in, err := exchangeRetry(m, server, ip, transportUDP)
+			if err != nil || in.Rcode != dns.RcodeSuccess {
+				v("childAddrs(%q) %s @%s: %v", host, dns.TypeToString[qtype], serverAddr(server, ip.String()), err)
+				continue
+			}
+			ips, _ := addrsFromAnswer(in, host, qtype)
+			out = append(out, ips...)
+		}
+		return out
+	})
+	var out []net.IP
+	for _, o := range outs {
+		for _, ip := range o.Out {
+			if !containsIP(out, ip) {
+				out = append(out, ip)
+			}
+		}
+	}
+	return out
+}
+
+// glueFamilies returns the addresses in the address families being queried
+func glueFamilies(ips []net.IP) []net.IP {
+	out := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if (queryIPv4 && ip.To4() != nil) || (queryIPv6 && ip.To4() == nil) {
+			out = append(out, ip)
+		}
+	}
+	sortIPs(out)
+	return out
+}
+
+func ipsEqual(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, ip := range a {
+		if !containsIP(b, ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkGlue compares the glue in the referrals from the parent with the addresses the nameservers have in the child zone,
+// and checks that every glue address answered the NS query in auth
+func checkGlue(parent, auth *queryGroup) uint {
+	var found uint = 0
+	glue, referral := parentGlue(parent)
+	if !referral {
+		// the parent is authoritative for the name itself, there is no delegation to have glue
+		return found
+	}
+
+	hosts := append([]string(nil), parent.NS...)
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		ips := glueFamilies(glue[host])
+		inZone := dns.IsSubDomain(dns.Fqdn(parent.Domain), dns.Fqdn(host))
+		if inZone && len(ips) == 0 {
+			finding("missing glue: %q NS %q is inside the zone but the parent has no glue for it", parent.Domain, host)
+			found++
+			continue
+		}
+		if len(ips) == 0 {
+			continue
+		}
+
+		// glue that does not answer
+		for _, ip := range ips {
+			if r, ok := auth.Results[host]; ok {
+				if a, ok := r.Addrs[ip.String()]; ok && a.Err != nil {
+					finding("unreachable glue: %q NS %s is glue from the parent but does not answer: %s", parent.Domain, serverAddr(host, ip.String()), a.Err)
+					found++
+				}
+			}
+		}
+
+		// glue that differs from the addresses in the zone of the nameserver
+		var child []net.IP
+		if inZone {
+			child = childAddrs(auth, host)
+		} else {
+			for _, qtype := range queryQtypes() {
+				addrs, err := resolveIterative(host, qtype, 0)
+				if err != nil {
+					v("checkGlue(%q) %q %s: %s", parent.Domain, host, dns.TypeToString[qtype], err)
+				}
+				child = append(child, addrs...)
+			}
+		}
+		child = glueFamilies(child)
+		if len(child) > 0 && !ipsEqual(ips, child) {
+			finding("glue mismatch: %q NS %q parent glue %v, authoritative addresses %v", parent.Domain, host, ips, child)
+			found++
+		}
+	}
+	return found
+}
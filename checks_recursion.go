@@ -0,0 +1,99 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"lame-dns/cache"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// recursionName is the name asked for with recursion desired to find open resolvers, it should not be in any zone being checked
+var recursionName = "example.com"
+
+// recursionProbe is the response of a nameserver address to a recursive query for recursionName
+type recursionProbe struct {
+	Err                error
+	Rcode              int
+	RecursionAvailable bool
+	Answered           bool // a non-authoritative answer for the name came back, so the server recursed for it
+}
+
+// Open is true if the server answered a recursive query for a name it is not authoritative for
+func (p *recursionProbe) Open() bool {
+	return p.Err == nil && p.Answered
+}
+
+// results of probing every nameserver address, keyed by address
+var recursionProbes = cache.New[*recursionProbe]()
+
+// probeRecursion sends a recursive query for recursionName to a single nameserver address
+func probeRecursion(server string, ip net.IP) *recursionProbe {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(recursionName), dns.TypeA)
+	m.RecursionDesired = true
+
+	in, err := exchangeRetry(m, server, ip, transportUDP)
+	if err != nil {
+		return &recursionProbe{Err: err}
+	}
+	out := &recursionProbe{Rcode: in.Rcode, RecursionAvailable: in.RecursionAvailable}
+	if in.Rcode == dns.RcodeSuccess && !in.Authoritative {
+		ips, _ := addrsFromAnswer(in, recursionName, dns.TypeA)
+		out.Answered = len(ips) > 0
+	}
+	return out
+}
+
+// checkRecursion probes every authoritative address in r for open recursion, and records the result in the address results.
+// Every address is only probed and reported once.
+func checkRecursion(r *queryGroup) uint {
+	var found uint = 0
+	if dns.IsSubDomain(dns.Fqdn(r.Domain), dns.Fqdn(recursionName)) {
+		// the servers are authoritative for the probe name
+		return found
+	}
+	outputs := forEachAnsweringAddr(r, func(server string, ip net.IP) bool {
+		addFun, first := recursionProbes.AddCheck(ip.String())
+		if !first {
+			probe, err := recursionProbes.GetWait(ip.String())
+			if err == nil {
+				r.Results[server].Addrs[ip.String()].Recursion = probe
+			}
+			return false
+		}
+		probe := probeRecursion(server, ip)
+		addFun(probe, nil)
+		r.Results[server].Addrs[ip.String()].Recursion = probe
+		return true
+	})
+	for _, o := range outputs {
+		probe := r.Results[o.Server].Addrs[o.Addr].Recursion
+		if !o.Out || probe == nil {
+			continue
+		}
+		switch {
+		case probe.Open():
+			finding("open recursion: %q is authoritative for %q and answered a recursive query for %q", serverAddr(o.Server, o.Addr), r.Domain, recursionName)
+			found++
+		case probe.Err != nil:
+			v("recursion probe @%s error: %s", serverAddr(o.Server, o.Addr), probe.Err)
+		case probe.RecursionAvailable:
+			v("recursion probe @%s: RA set without a recursive answer, rcode %s", serverAddr(o.Server, o.Addr), dns.RcodeToString[probe.Rcode])
+		}
+	}
+	return found
+}
@@ -0,0 +1,168 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"lame-dns/cache"
+	"sort"
+	"sync"
+
+	"github.com/miekg/dns"
+	"golang.org/x/sync/errgroup"
+)
+
+// registration is the delegation state of the registrable domain of a nameserver host
+type registration struct {
+	Delegated bool
+	Exists    bool   // the parent has the name, but no delegation for it
+	Parent    string // zone that answered for the domain
+	Err       error
+}
+
+var nsDomainStatus = cache.New[registration]()
+
+// nsDomains holds the nameserver hosts under every registrable domain, and the domains that are not delegated,
+// either because they do not exist or because the parent holds them without a delegation
+var nsDomains = struct {
+	sync.Mutex
+	hosts        map[string]map[string]bool
+	unregistered map[string]registration
+}{hosts: make(map[string]map[string]bool), unregistered: make(map[string]registration)}
+
+// delegationStatus asks the servers of the public suffix of domain whether domain is delegated, following any
+// referrals for suffixes that are delegated further down, ex: co.uk under uk
+func delegationStatus(domain string) registration {
+	name := dns.Fqdn(domain)
+	parent := icannSuffix(domain)
+	servers := closestServers(parent)
+	for i := 0; i < maxReferrals; i++ {
+		in, err := queryAny(servers, name, dns.TypeNS, 0)
+		if err != nil {
+			return registration{Err: err}
+		}
+		if len(in.Ns) > 0 {
+			parent = cleanDomain(in.Ns[0].Header().Name)
+		}
+		if in.Rcode == dns.RcodeNameError {
+			return registration{Parent: parent}
+		}
+		if in.Rcode != dns.RcodeSuccess {
+			return registration{Err: fmt.Errorf("%s NS: %s", name, dns.RcodeToString[in.Rcode])}
+		}
+		for _, r := range append(in.Answer, in.Ns...) {
+			if t, ok := r.(*dns.NS); ok && cleanDomain(t.Hdr.Name) == cleanDomain(domain) {
+				return registration{Delegated: true, Parent: parent}
+			}
+		}
+		if in.Authoritative {
+			// NODATA, the name is registered but held in the parent zone directly or covered by a wildcard
+			return registration{Exists: true, Parent: parent}
+		}
+
+		// referral to a zone between the suffix and the domain
+		next := make([]string, 0, len(in.Ns))
+		for _, r := range in.Ns {
+			if t, ok := r.(*dns.NS); ok && dns.IsSubDomain(t.Hdr.Name, name) {
+				next = append(next, cleanDomain(t.Ns))
+			}
+		}
+		if len(next) == 0 {
+			return registration{Err: fmt.Errorf("%s NS: no answer or referral", name)}
+		}
+		addGlue(in, next)
+		servers = next
+	}
+	return registration{Err: fmt.Errorf("%s NS: too many referrals", name)}
+}
+
+// checkRegisteredNS checks that the registrable domain of every nameserver host is delegated the first time it is seen,
+// and returns the number of domains that were newly found to not be. The findings are reported by reportUnregisteredNS
+// once every input name depending on the domain is known.
+func checkRegisteredNS(hosts []string) uint {
+	var found uint = 0
+	var m sync.Mutex
+	var g errgroup.Group
+	for _, host := range hosts {
+		domain := registrableDomain(host)
+		if domain == "" {
+			continue
+		}
+		nsDomains.Lock()
+		if nsDomains.hosts[domain] == nil {
+			nsDomains.hosts[domain] = make(map[string]bool)
+		}
+		nsDomains.hosts[domain][host] = true
+		nsDomains.Unlock()
+
+		addFun, first := nsDomainStatus.AddCheck(domain)
+		if !first {
+			continue
+		}
+		g.Go(func() error {
+			status := delegationStatus(domain)
+			addFun(status, nil)
+			if status.Err != nil {
+				v("could not check the delegation of nameserver domain %q: %v", domain, status.Err)
+				return nil
+			}
+			if status.Delegated {
+				return nil
+			}
+			v("nameserver domain %q is not delegated by %q", domain, status.Parent)
+			nsDomains.Lock()
+			nsDomains.unregistered[domain] = status
+			nsDomains.Unlock()
+			m.Lock()
+			found++
+			m.Unlock()
+			return nil
+		})
+	}
+	g.Wait()
+	return found
+}
+
+// reportUnregisteredNS logs a finding for every nameserver domain that is not delegated, with every input name exposed through it.
+// Only domains the registry answers NXDOMAIN for can be registered, the others exist without a delegation.
+func reportUnregisteredNS() {
+	nsDomains.Lock()
+	defer nsDomains.Unlock()
+	domains := make([]string, 0, len(nsDomains.unregistered))
+	for domain := range nsDomains.unregistered {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+	for _, domain := range domains {
+		hosts := stringMapToArrayKeys(nsDomains.hosts[domain])
+		sort.Strings(hosts)
+		exposed := make(map[string]bool)
+		for _, host := range hosts {
+			for _, name := range deps.InputsUsing(host) {
+				exposed[name] = true
+			}
+		}
+		inputs := stringMapToArrayKeys(exposed)
+		sort.Strings(inputs)
+		status := nsDomains.unregistered[domain]
+		if status.Exists {
+			finding("undelegated NS domain: %q exists in %q but is not delegated, nameservers %v are used by %d domains: %v",
+				domain, status.Parent, hosts, len(inputs), inputs)
+			continue
+		}
+		highFinding("unregistered NS domain: %q does not exist in %q and can be registered by anyone, nameservers %v are used by %d domains: %v",
+			domain, status.Parent, hosts, len(inputs), inputs)
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/miekg/dns"
+)
+
+// querySOA asks a single nameserver address for the SOA of zone, and returns it if the answer was authoritative
+func querySOA(server string, ip net.IP, zone string) (*dns.SOA, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(zone), dns.TypeSOA)
+	m.RecursionDesired = false
+
+	in, err := exchangeRetry(m, server, ip, transportUDP)
+	if err != nil {
+		return nil, err
+	}
+	if in.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("rcode %s", dns.RcodeToString[in.Rcode])
+	}
+	if !in.Authoritative {
+		return nil, fmt.Errorf("AA bit not set")
+	}
+	for _, r := range in.Answer {
+		if t, ok := r.(*dns.SOA); ok && cleanDomain(t.Hdr.Name) == cleanDomain(zone) {
+			return t, nil
+		}
+	}
+	return nil, fmt.Errorf("no SOA in answer")
+}
+
+// serialBefore compares SOA serials with serial number arithmetic, RFC 1982
+func serialBefore(a, b uint32) bool {
+	return a != b && int32(b-a) > 0
+}
+
+// soaFields formats the SOA fields that should be the same on every server, everything but the serial
+func soaFields(soa *dns.SOA) string {
+	return fmt.Sprintf("MNAME: %s RNAME: %s REFRESH: %d RETRY: %d EXPIRE: %d MINIMUM: %d",
+		cleanDomain(soa.Ns), cleanDomain(soa.Mbox), soa.Refresh, soa.Retry, soa.Expire, soa.Minttl)
+}
+
+// checkSOA queries the SOA from every authoritative address in r, records it in the address results,
+// and compares the serials and other fields across all of them
+func checkSOA(r *queryGroup) uint {
+	var found uint = 0
+	outs := forEachAnsweringAddr(r, func(server string, ip net.IP) error {
+		result := r.Results[server].Addrs[ip.String()]
+		if kind, _ := classifyLame(result, r.Domain); kind != "" {
+			// lame servers are reported by checkLame
+			return nil
+		}
+		soa, err := querySOA(server, ip, r.Domain)
+		result.SOA = soa
+		return err
+	})
+
+	var soas []addrOutput[*dns.SOA]
+	for _, out := range outs {
+		if out.Out != nil {
+			finding("SOA failure: %q @%s: %s", r.Domain, serverAddr(out.Server, out.Addr), out.Out)
+			found++
+			continue
+		}
+		if soa := r.Results[out.Server].Addrs[out.Addr].SOA; soa != nil {
+			soas = append(soas, addrOutput[*dns.SOA]{Server: out.Server, Addr: out.Addr, Out: soa})
+		}
+	}
+	if len(soas) < 2 {
+		return found
+	}
+
+	// serials
+	newest := soas[0].Out.Serial
+	for _, soa := range soas {
+		if serialBefore(newest, soa.Out.Serial) {
+			newest = soa.Out.Serial
+		}
+	}
+	var spread uint32 = 0
+	behind := make([]string, 0)
+	for _, soa := range soas {
+		if soa.Out.Serial != newest {
+			behind = append(behind, fmt.Sprintf("%s serial %d", serverAddr(soa.Server, soa.Addr), soa.Out.Serial))
+			if newest-soa.Out.Serial > spread {
+				spread = newest - soa.Out.Serial
+			}
+		}
+	}
+	if len(behind) > 0 {
+		finding("SOA serial mismatch: %q newest serial %d, %d of %d servers behind by up to %d: %v", r.Domain, newest, len(behind), len(soas), spread, behind)
+		found++
+	}
+
+	// other fields
+	fields := make(map[string][]string)
+	for _, soa := range soas {
+		f := soaFields(soa.Out)
+		fields[f] = append(fields[f], serverAddr(soa.Server, soa.Addr))
+	}
+	if len(fields) > 1 {
+		variants := make([]string, 0, len(fields))
+		for f, servers := range fields {
+			variants = append(variants, fmt.Sprintf("%s from %v", f, servers))
+		}
+		sort.Strings(variants)
+		finding("SOA fields differ: %q: %v", r.Domain, variants)
+		found++
+	}
+	return found
+}
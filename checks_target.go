@@ -0,0 +1,111 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"lame-dns/cache"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// CNAME targets of nameserver hosts, "" if the host is not an alias, keyed by host
+var nsAliases = cache.New[string]()
+
+// hostnameError returns why name is not a valid hostname, RFC 952 and RFC 1123, or "" if it is valid
+func hostnameError(name string) string {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" {
+		return "empty name"
+	}
+	if len(name) > 253 {
+		return fmt.Sprintf("name is %d characters long", len(name))
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" {
+			return "empty label"
+		}
+		if len(label) > 63 {
+			return fmt.Sprintf("label %q is %d characters long", label, len(label))
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Sprintf("label %q starts or ends with a hyphen", label)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return fmt.Sprintf("label %q has the character %q", label, c)
+			}
+		}
+	}
+	return ""
+}
+
+// isIPHost returns true if the nameserver host is an IP address instead of a name, which checkNSTargets reports,
+// the checks that resolve nameserver hosts skip it as there is nothing to look up
+func isIPHost(host string) bool {
+	return net.ParseIP(strings.TrimSuffix(host, ".")) != nil
+}
+
+// nsAlias returns the CNAME target of host, or "" if it is not an alias
+func nsAlias(host string) string {
+	if isIPHost(host) {
+		return ""
+	}
+	addFun, first := nsAliases.AddCheck(host)
+	if !first {
+		target, _ := nsAliases.GetWait(host)
+		return target
+	}
+	target := ""
+	in, err := lookup(host, dns.TypeA, 0)
+	if err != nil {
+		v("nsAlias(%q) error: %s", host, err)
+	} else {
+		for _, rr := range in.Answer {
+			if t, ok := rr.(*dns.CNAME); ok && cleanDomain(t.Hdr.Name) == cleanDomain(host) {
+				target = cleanDomain(t.Target)
+			}
+		}
+	}
+	addFun(target, nil)
+	return target
+}
+
+// checkNSTargets checks that every nameserver host of zone is a valid hostname, and not an IP address or an alias, RFC 2181 section 10.3
+func checkNSTargets(zone string, hosts []string) uint {
+	var found uint = 0
+	sorted := append([]string(nil), hosts...)
+	sort.Strings(sorted)
+	for _, host := range sorted {
+		if isIPHost(host) {
+			finding("NS target is an IP address: %q NS %q", zone, host)
+			found++
+			continue
+		}
+		if reason := hostnameError(host); reason != "" {
+			finding("invalid NS hostname: %q NS %q: %s", zone, host, reason)
+			found++
+			continue
+		}
+		if target := nsAlias(host); target != "" {
+			finding("NS target is a CNAME: %q NS %q is an alias for %q", zone, host, target)
+			found++
+		}
+	}
+	return found
+}
@@ -0,0 +1,932 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"lame-dns/cache"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestClassifyLame(t *testing.T) {
+	tests := []struct {
+		name   string
+		result queryResult
+		want   string
+	}{
+		{"ok", queryResult{Authoritative: true, NS: []string{"ns1.example.com"}, NSOwner: "example.com", NSSection: sectionAnswer}, ""},
+		{"timeout", queryResult{Err: errors.New("i/o timeout")}, lameUnreachable},
+		{"refused", queryResult{Rcode: dns.RcodeRefused}, lameRefused},
+		{"servfail", queryResult{Rcode: dns.RcodeServerFailure}, lameServFail},
+		{"nxdomain", queryResult{Rcode: dns.RcodeNameError, Authoritative: true}, lameNXDomain},
+		{"upward referral", queryResult{NS: []string{"a.root-servers.net"}, NSOwner: "", NSSection: sectionAuthority}, lameUpwardReferral},
+		{"referral", queryResult{NS: []string{"ns1.example.net"}, NSOwner: "example.com", NSSection: sectionAuthority}, lameReferral},
+		{"not authoritative", queryResult{NS: []string{"ns1.example.com"}, NSOwner: "example.com", NSSection: sectionAnswer}, lameNotAuthoritative},
+		{"no NS", queryResult{Authoritative: true}, lameNoNS},
+	}
+	for _, test := range tests {
+		if got, _ := classifyLame(&test.result, "example.com"); got != test.want {
+			t.Errorf("classifyLame(%s) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestCheckTCP(t *testing.T) {
+	setupTestRoot(t)
+	saved := *tcpCheck
+	*tcpCheck = true
+	t.Cleanup(func() { *tcpCheck = saved })
+
+	startTestServer(t, "127.0.0.3", zoneHandler(t, `
+test. 3600 IN SOA ns.test. hostmaster.test. 1 3600 600 86400 300
+test. 3600 IN NS ns.test.
+ns.test. 3600 IN A 127.0.0.3
+example.test. 3600 IN NS ns1.example.test.
+ns1.example.test. 3600 IN A 127.0.0.4
+`))
+	// ns1.example.test only answers over UDP, connecting over TCP is refused
+	pc, err := net.ListenPacket("udp", net.JoinHostPort("127.0.0.4", dnsPort))
+	if err != nil {
+		t.Fatalf("ListenPacket() error: %s", err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: pc, NotifyStartedFunc: func() { close(started) }, Handler: zoneHandler(t, `
+example.test. 3600 IN SOA ns1.example.test. hostmaster.example.test. 1 3600 600 86400 300
+example.test. 3600 IN NS ns1.example.test.
+ns1.example.test. 3600 IN A 127.0.0.4
+`)}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	group := testAuthGroup("example.test", "127.0.0.4")
+	if found := checkTCP(group); found != 1 {
+		t.Errorf("checkTCP() = %d, want 1", found)
+	}
+	if tcp := group.Results["ns1.example.test"].Addrs["127.0.0.4"].Transports[transportTCP]; tcp == nil || tcp.Err == nil {
+		t.Errorf("TCP result = %v, want an error", tcp)
+	}
+
+	w := &nameWork{Name: "www.example.test"}
+	if err := processName(context.Background(), w); err != nil {
+		t.Fatalf("processName() error: %s", err)
+	}
+	if w.Lame || w.Problems != 1 {
+		t.Errorf("processName(%q) Lame: %t, Problems: %d, want only the TCP failure", w.Name, w.Lame, w.Problems)
+	}
+}
+
+func TestEDNSTests(t *testing.T) {
+	setupTestEnv(t)
+	// a server from before EDNS0, answering every query without an OPT record
+	startTestServer(t, "127.0.0.2", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		w.WriteMsg(m)
+	})
+
+	// a compliant server, answering EDNS0 queries with a version 0 OPT record that only echoes the DO bit
+	compliant := func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		opt := r.IsEdns0()
+		if opt == nil {
+			w.WriteMsg(m)
+			return
+		}
+		m.SetEdns0(dns.DefaultMsgSize, opt.Do())
+		if opt.Version() != 0 {
+			m.Rcode = dns.RcodeBadVers
+		}
+		w.WriteMsg(m)
+	}
+	startTestServer(t, "127.0.0.3", compliant)
+
+	for _, test := range ednsTests {
+		problem := runEDNSTest(test, "ns1.example.test", net.ParseIP("127.0.0.2"), "example.test")
+		if test.edns == nil && problem != "" {
+			t.Errorf("runEDNSTest(%s) = %q, want pass", test.name, problem)
+		}
+		if test.edns != nil && problem == "" {
+			t.Errorf("runEDNSTest(%s) passed, want failure", test.name)
+		}
+		if problem := runEDNSTest(test, "ns1.example.test", net.ParseIP("127.0.0.3"), "example.test"); problem != "" {
+			t.Errorf("runEDNSTest(%s) on a compliant server = %q, want pass", test.name, problem)
+		}
+	}
+	if found := checkEDNS(testAuthGroup("example.test", "127.0.0.3")); found != 0 {
+		t.Errorf("checkEDNS() on a compliant server = %d, want 0", found)
+	}
+
+	// packet loss is retried, and a server that does not answer at all is not failing the tests
+	if err := setClientConfig(clientConfig{DialTimeout: time.Second, ReadTimeout: 200 * time.Millisecond, WriteTimeout: time.Second, Retries: 1}); err != nil {
+		t.Fatalf("setClientConfig(): %s", err)
+	}
+	var m sync.Mutex
+	queries := 0
+	startTestServer(t, "127.0.0.4", func(w dns.ResponseWriter, r *dns.Msg) {
+		m.Lock()
+		queries++
+		drop := queries%2 == 1
+		m.Unlock()
+		if !drop {
+			compliant(w, r)
+		}
+	})
+	for _, addr := range []string{"127.0.0.4", "127.0.0.5"} {
+		for _, test := range ednsTests {
+			if problem := runEDNSTest(test, "ns1.example.test", net.ParseIP(addr), "example.test"); problem != "" {
+				t.Errorf("runEDNSTest(%s) @%s = %q, want pass", test.name, addr, problem)
+			}
+		}
+	}
+	if queries != 2*len(ednsTests) {
+		t.Errorf("server dropping every other query got %d queries, want every test retried once: %d", queries, 2*len(ednsTests))
+	}
+}
+
+func TestCheckDoT(t *testing.T) {
+	setupTestEnv(t)
+	savedExpected := expectedDoT
+	expectedDoT = []string{"example.test"}
+	t.Cleanup(func() { expectedDoT = savedExpected })
+
+	answer := func(ns string) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Authoritative = true
+			m.Answer = append(m.Answer, &dns.NS{
+				Hdr: dns.RR_Header{Name: "example.test.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600},
+				Ns:  ns,
+			})
+			w.WriteMsg(m)
+		}
+	}
+	startTestTLSServer(t, "127.0.0.2", answer("ns1.example.test."))
+	startTestTLSServer(t, "127.0.0.3", answer("ns9.example.test."))
+
+	group := testAuthGroup("example.test", "127.0.0.2", "127.0.0.3", "127.0.0.4")
+
+	// 127.0.0.3 answers differently over TLS and 127.0.0.4 does not support TLS at all
+	if found := checkDoT(group); found != 2 {
+		t.Errorf("checkDoT() = %d, want 2", found)
+	}
+	tls := group.Results["ns1.example.test"].Addrs["127.0.0.2"].Transports[transportTLS]
+	if tls == nil || tls.Err != nil || !tls.Authoritative {
+		t.Errorf("TLS result for 127.0.0.2 = %v, want an authoritative answer", tls)
+	}
+}
+
+func TestProbeDoT(t *testing.T) {
+	setupTestRoot(t)
+	if err := setClientConfig(clientConfig{DialTimeout: time.Second, ReadTimeout: time.Second, WriteTimeout: time.Second, Retries: 2, Backoff: 10 * time.Millisecond}); err != nil {
+		t.Fatalf("setClientConfig(): %s", err)
+	}
+	savedTimeout := dotProbeTimeout
+	dotProbeTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { dotProbeTimeout = savedTimeout })
+	startTestServer(t, "127.0.0.3", zoneHandler(t, `
+test. 3600 IN SOA ns.test. hostmaster.test. 1 3600 600 86400 300
+test. 3600 IN NS ns.test.
+ns.test. 3600 IN A 127.0.0.3
+`))
+
+	// 127.0.0.5 accepts connections on the DoT port but never completes the TLS handshake
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.5", dotPort))
+	if err != nil {
+		t.Fatalf("Listen() error: %s", err)
+	}
+	var m sync.Mutex
+	var conns []net.Conn
+	t.Cleanup(func() {
+		l.Close()
+		m.Lock()
+		defer m.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			m.Lock()
+			conns = append(conns, c)
+			m.Unlock()
+		}
+	}()
+
+	// DoT is neither expected nor advertised, so a failure is not a finding and the address is only tried once
+	group := testAuthGroup("example.test", "127.0.0.5")
+	if found := checkDoT(group); found != 0 {
+		t.Errorf("checkDoT() = %d, want 0", found)
+	}
+	if tls := group.Results["ns1.example.test"].Addrs["127.0.0.5"].Transports[transportTLS]; tls == nil || tls.Err == nil {
+		t.Errorf("TLS result for 127.0.0.5 = %v, want an error", tls)
+	}
+	m.Lock()
+	defer m.Unlock()
+	if len(conns) != 1 {
+		t.Errorf("DoT connections = %d, want 1", len(conns))
+	}
+}
+
+func TestDanglingNS(t *testing.T) {
+	setupTestRoot(t)
+	savedDeps, savedStatus := deps, nsHostStatus
+	deps, nsHostStatus = newDependencies(), cache.New[hostStatus]()
+	t.Cleanup(func() { deps, nsHostStatus = savedDeps, savedStatus })
+
+	// example.test is delegated to a host that does not exist, and to one that exists without addresses
+	startTestServer(t, "127.0.0.3", zoneHandler(t, `
+test. 3600 IN SOA ns.test. hostmaster.test. 1 3600 600 86400 300
+test. 3600 IN NS ns.test.
+ns.test. 3600 IN A 127.0.0.3
+nodata.test. 3600 IN TXT "no addresses"
+example.test. 3600 IN NS gone.test.
+example.test. 3600 IN NS nodata.test.
+`))
+
+	for _, name := range []string{"example.test", "www.example.test"} {
+		if err := processName(context.Background(), &nameWork{Name: name}); err != nil {
+			t.Fatalf("processName(%q) error: %s", name, err)
+		}
+	}
+
+	for host, want := range map[string]string{"gone.test": hostNXDomain, "nodata.test": hostNoData} {
+		status, _ := nsHostStatus.Get(host)
+		if status.Status != want {
+			t.Errorf("status of %q = %q, want %q", host, status.Status, want)
+		}
+		if inputs := deps.InputsUsing(host); !StringArrayEquals(inputs, []string{"example.test", "www.example.test"}) {
+			t.Errorf("InputsUsing(%q) = %v, want both input names", host, inputs)
+		}
+	}
+}
+
+func TestIPHostNS(t *testing.T) {
+	setupTestRoot(t)
+	savedStatus, savedZones, savedAliases := nsHostStatus, nsHostZones, nsAliases
+	nsHostStatus, nsHostZones, nsAliases = cache.New[hostStatus](), cache.New[[]string](), cache.New[string]()
+	t.Cleanup(func() { nsHostStatus, nsHostZones, nsAliases = savedStatus, savedZones, savedAliases })
+
+	// IP addresses are only reported as invalid targets, the checks that resolve nameserver hosts have nothing to look up
+	hosts := []string{"192.0.2.1", "2001:db8::53"}
+	if found := checkNSTargets("example.test", hosts); found != 2 {
+		t.Errorf("checkNSTargets() = %d, want 2", found)
+	}
+	if found := checkDanglingNS(hosts); found != 0 {
+		t.Errorf("checkDanglingNS() = %d, want 0", found)
+	}
+	if found := checkRegisteredNS(hosts); found != 0 {
+		t.Errorf("checkRegisteredNS() = %d, want 0", found)
+	}
+	walkNSHostZones(hosts)
+	for _, host := range hosts {
+		if _, ok := nsHostStatus.Get(host); ok {
+			t.Errorf("status of %q was resolved", host)
+		}
+		if _, ok := nsHostZones.Get(host); ok {
+			t.Errorf("zone cuts of %q were walked", host)
+		}
+		if _, ok := nsAliases.Get(host); ok {
+			t.Errorf("alias of %q was looked up", host)
+		}
+	}
+}
+
+func TestUnregisteredNS(t *testing.T) {
+	setupTestRoot(t)
+	savedDomains, savedStatus := nsDomains.hosts, nsDomainStatus
+	nsDomains.hosts, nsDomains.unregistered = make(map[string]map[string]bool), make(map[string]registration)
+	nsDomainStatus = cache.New[registration]()
+	t.Cleanup(func() {
+		nsDomains.hosts, nsDomains.unregistered, nsDomainStatus = savedDomains, make(map[string]registration), savedStatus
+	})
+
+	// lapsed.test does not exist, held.test exists in test without a delegation, ns.hosted.test is delegated to a
+	// server that answers for it
+	startTestServer(t, "127.0.0.3", zoneHandler(t, `
+test. 3600 IN SOA ns.test. hostmaster.test. 1 3600 600 86400 300
+test. 3600 IN NS ns.test.
+ns.test. 3600 IN A 127.0.0.3
+held.test. 3600 IN A 127.0.0.5
+hosted.test. 3600 IN NS ns.hosted.test.
+ns.hosted.test. 3600 IN A 127.0.0.4
+`))
+
+	if n := checkRegisteredNS([]string{"ns1.lapsed.test", "ns2.lapsed.test", "ns.held.test", "ns.hosted.test"}); n != 2 {
+		t.Errorf("checkRegisteredNS() = %d, want 2", n)
+	}
+	if status, _ := nsDomainStatus.Get("lapsed.test"); status.Delegated || status.Exists || status.Err != nil || status.Parent != "test" {
+		t.Errorf("status of lapsed.test = %+v, want NXDOMAIN from test", status)
+	}
+	if status, _ := nsDomainStatus.Get("held.test"); status.Delegated || !status.Exists || status.Err != nil {
+		t.Errorf("status of held.test = %+v, want existing but not delegated", status)
+	}
+	if status, _ := nsDomainStatus.Get("hosted.test"); !status.Delegated {
+		t.Errorf("status of hosted.test = %+v, want delegated", status)
+	}
+	if hosts := stringMapToArrayKeys(nsDomains.hosts["lapsed.test"]); len(hosts) != 2 {
+		t.Errorf("hosts under lapsed.test = %v, want both nameservers", hosts)
+	}
+}
+
+func TestCheckSOA(t *testing.T) {
+	setupTestEnv(t)
+	zone := func(serial, refresh string) string {
+		return `
+example.test. 3600 IN SOA ns1.example.test. hostmaster.example.test. ` + serial + ` ` + refresh + ` 600 86400 300
+example.test. 3600 IN NS ns1.example.test.
+`
+	}
+	// 127.0.0.3 is behind across the serial wrap, 127.0.0.4 also has a different refresh
+	startTestServer(t, "127.0.0.2", zoneHandler(t, zone("5", "3600")))
+	startTestServer(t, "127.0.0.3", zoneHandler(t, zone("4294967290", "3600")))
+	startTestServer(t, "127.0.0.4", zoneHandler(t, zone("5", "7200")))
+
+	group := testAuthGroup("example.test", "127.0.0.2", "127.0.0.3", "127.0.0.4")
+
+	if found := checkSOA(group); found != 2 {
+		t.Errorf("checkSOA() = %d, want 2", found)
+	}
+	for addr, want := range map[string]uint32{"127.0.0.2": 5, "127.0.0.3": 4294967290, "127.0.0.4": 5} {
+		if soa := group.Results["ns1.example.test"].Addrs[addr].SOA; soa == nil || soa.Serial != want {
+			t.Errorf("SOA for %s = %v, want serial %d", addr, soa, want)
+		}
+	}
+	if !serialBefore(4294967290, 5) || serialBefore(5, 4294967290) {
+		t.Errorf("serialBefore() does not wrap around")
+	}
+}
+
+func TestCheckGlue(t *testing.T) {
+	setupTestRoot(t)
+	// ns1 has more addresses in the zone than in the glue, ns2 has no glue, and the glue of ns3 does not answer
+	startTestServer(t, "127.0.0.3", zoneHandler(t, `
+test. 3600 IN SOA ns.test. hostmaster.test. 1 3600 600 86400 300
+test. 3600 IN NS ns.test.
+ns.test. 3600 IN A 127.0.0.3
+example.test. 3600 IN NS ns1.example.test.
+example.test. 3600 IN NS ns2.example.test.
+example.test. 3600 IN NS ns3.example.test.
+ns1.example.test. 3600 IN A 127.0.0.4
+ns3.example.test. 3600 IN A 127.0.0.6
+`))
+	startTestServer(t, "127.0.0.4", zoneHandler(t, `
+example.test. 3600 IN SOA ns1.example.test. hostmaster.example.test. 1 3600 600 86400 300
+example.test. 3600 IN NS ns1.example.test.
+example.test. 3600 IN NS ns2.example.test.
+example.test. 3600 IN NS ns3.example.test.
+ns1.example.test. 3600 IN A 127.0.0.4
+ns1.example.test. 3600 IN A 127.0.0.5
+ns2.example.test. 3600 IN A 127.0.0.4
+ns3.example.test. 3600 IN A 127.0.0.6
+`))
+
+	nsAddrs.Add("ns.test", net.ParseIP("127.0.0.3"))
+	parent, err := queryNSParallel("example.test", []string{"ns.test"})
+	if err != nil {
+		t.Fatalf("queryNSParallel() error: %s", err)
+	}
+	glue, referral := parentGlue(parent)
+	if !referral || len(glue["ns1.example.test"]) != 1 || len(glue["ns2.example.test"]) != 0 {
+		t.Errorf("parentGlue() = %v, %t, want glue for ns1 and ns3 from a referral", glue, referral)
+	}
+
+	_, auth := checkLame(parent)
+	if auth == nil {
+		t.Fatal("checkLame() returned no authoritative results")
+	}
+	if found := checkGlue(parent, auth); found != 3 {
+		t.Errorf("checkGlue() = %d, want 3", found)
+	}
+}
+
+func TestCheckNSTTL(t *testing.T) {
+	saved := nsTTLPolicy
+	t.Cleanup(func() { nsTTLPolicy = saved })
+
+	parent := &queryGroup{
+		Domain: "example.test",
+		Results: map[string]*queryResult{
+			"ns.test": {Addrs: map[string]*queryResult{
+				"192.0.2.1": {NS: []string{"ns1.example.test"}, NSOwner: "example.test", NSSection: sectionAuthority, NSTTL: 172800},
+			}},
+		},
+	}
+	for _, tc := range []struct {
+		ttls  []uint32
+		ratio float64
+		want  uint
+	}{
+		{[]uint32{86400, 86400}, 10, 0},
+		// the usual .com setup of 2 days in the referral and 1 hour at the servers, not compared by default
+		{[]uint32{3600, 3600}, saved.Ratio, 0},
+		{[]uint32{3600, 3600}, 10, 1},
+		// too low, and far below the parent
+		{[]uint32{60, 60}, 10, 2},
+		// the servers differ, and one is far below the parent
+		{[]uint32{86400, 3600}, 10, 2},
+	} {
+		nsTTLPolicy = ttlPolicy{Min: 5 * time.Minute, Max: 24 * time.Hour, Ratio: tc.ratio}
+		group := testAuthGroup("example.test", "192.0.2.2", "192.0.2.3")
+		group.Results["ns1.example.test"].Addrs["192.0.2.2"].NSTTL = tc.ttls[0]
+		group.Results["ns1.example.test"].Addrs["192.0.2.3"].NSTTL = tc.ttls[1]
+		if found := checkNSTTL(parent, group); found != tc.want {
+			t.Errorf("checkNSTTL() with TTLs %v and ratio %g = %d, want %d", tc.ttls, tc.ratio, found, tc.want)
+		}
+	}
+}
+
+func TestCheckDiversity(t *testing.T) {
+	table, err := parseASNTable(strings.NewReader(`# prefix to ASN
+192.0.2.0/24 AS64500
+192.0.2.128 25 64501
+2001:db8::/32 64502
+`), "test")
+	if err != nil {
+		t.Fatalf("parseASNTable() error: %s", err)
+	}
+	for addr, want := range map[string]string{"192.0.2.1": "64500", "192.0.2.200": "64501", "2001:db8:1::1": "64502", "198.51.100.1": ""} {
+		if asn := table.Lookup(net.ParseIP(addr)); asn != want {
+			t.Errorf("Lookup(%s) = %q, want %q", addr, asn, want)
+		}
+	}
+	savedASNs, savedPolicy := asns, nsDiversity
+	asns, nsDiversity = table, diversityPolicy{Hosts: 2, Prefixes: 2, ASNs: 2}
+	t.Cleanup(func() { asns, nsDiversity = savedASNs, savedPolicy })
+
+	group := func(servers map[string][]string) *queryGroup {
+		g := &queryGroup{Domain: "example.test", Results: make(map[string]*queryResult)}
+		for server, addrs := range servers {
+			g.Results[server] = &queryResult{Addrs: make(map[string]*queryResult)}
+			for _, addr := range addrs {
+				g.Results[server].Addrs[addr] = &queryResult{}
+			}
+		}
+		return g
+	}
+	for _, tc := range []struct {
+		servers map[string][]string
+		want    uint
+	}{
+		{map[string][]string{"ns1.example.test": {"192.0.2.1"}, "ns2.example.test": {"2001:db8::1"}}, 0},
+		// one host in one network and ASN
+		{map[string][]string{"ns1.example.test": {"192.0.2.1"}}, 3},
+		// two hosts on the same address
+		{map[string][]string{"ns1.example.test": {"192.0.2.1"}, "ns2.example.test": {"192.0.2.1"}}, 3},
+		// two networks in the same /24, with different ASNs
+		{map[string][]string{"ns1.example.test": {"192.0.2.1"}, "ns2.example.test": {"192.0.2.200"}}, 1},
+	} {
+		if found := checkDiversity(group(tc.servers)); found != tc.want {
+			t.Errorf("checkDiversity(%v) = %d, want %d", tc.servers, found, tc.want)
+		}
+	}
+}
+
+func TestCheckRecursion(t *testing.T) {
+	setupTestEnv(t)
+	savedProbes := recursionProbes
+	recursionProbes = cache.New[*recursionProbe]()
+	t.Cleanup(func() { recursionProbes = savedProbes })
+
+	resolver := func(recurse bool) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.RecursionAvailable = true
+			if recurse && r.RecursionDesired {
+				m.Answer = append(m.Answer, &dns.A{
+					Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+					A:   net.ParseIP("192.0.2.1"),
+				})
+			} else {
+				m.Rcode = dns.RcodeRefused
+			}
+			w.WriteMsg(m)
+		}
+	}
+	// 127.0.0.2 recurses, 127.0.0.3 sets RA but refuses
+	startTestServer(t, "127.0.0.2", resolver(true))
+	startTestServer(t, "127.0.0.3", resolver(false))
+
+	g := testAuthGroup("example.test", "127.0.0.2", "127.0.0.3")
+	if found := checkRecursion(g); found != 1 {
+		t.Errorf("checkRecursion() = %d, want 1", found)
+	}
+	if p := g.Results["ns1.example.test"].Addrs["127.0.0.3"].Recursion; p == nil || p.Open() || !p.RecursionAvailable {
+		t.Errorf("probe of 127.0.0.3 = %+v, want RA without an answer", p)
+	}
+	// the same addresses are not reported again for another zone
+	g = testAuthGroup("example2.test", "127.0.0.2", "127.0.0.3")
+	if found := checkRecursion(g); found != 0 {
+		t.Errorf("checkRecursion() for a second zone = %d, want 0", found)
+	}
+	if p := g.Results["ns1.example.test"].Addrs["127.0.0.2"].Recursion; p == nil || !p.Open() {
+		t.Errorf("probe of 127.0.0.2 = %+v, want open", p)
+	}
+}
+
+func TestCheckAXFR(t *testing.T) {
+	setupTestEnv(t)
+	zone := `
+example.test. 3600 IN SOA hidden.example.test. hostmaster.example.test. 1 3600 600 86400 300
+example.test. 3600 IN NS ns1.example.test.
+ns1.example.test. 3600 IN A 127.0.0.2
+www.example.test. 3600 IN A 192.0.2.1
+`
+	var records []dns.RR
+	zp := dns.NewZoneParser(strings.NewReader(zone), "", "")
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		records = append(records, rr)
+	}
+	transfer := func(open bool) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			if !open || r.Question[0].Qtype != dns.TypeAXFR {
+				m.Rcode = dns.RcodeRefused
+			} else {
+				m.Answer = append(append(m.Answer, records...), records[0])
+			}
+			w.WriteMsg(m)
+		}
+	}
+	// 127.0.0.2 and the hidden primary at 127.0.0.4 allow transfers, 127.0.0.3 refuses them
+	startTestServer(t, "127.0.0.2", transfer(true))
+	startTestServer(t, "127.0.0.3", transfer(false))
+	startTestServer(t, "127.0.0.4", transfer(true))
+	nsAddrs.Add("hidden.example.test", net.ParseIP("127.0.0.4"))
+
+	group := testAuthGroup("example.test", "127.0.0.2", "127.0.0.3")
+	for _, r := range group.Results["ns1.example.test"].Addrs {
+		r.SOA = records[0].(*dns.SOA)
+	}
+	if found := checkAXFR(group); found != 2 {
+		t.Errorf("checkAXFR() = %d, want 2", found)
+	}
+	if a := group.Results["ns1.example.test"].Addrs["127.0.0.2"].AXFR; a == nil || a.Status != axfrOpen || !a.Complete || a.Records != 5 {
+		t.Errorf("AXFR from 127.0.0.2 = %+v, want a complete transfer of 5 records", a)
+	}
+	if a := group.Results["ns1.example.test"].Addrs["127.0.0.3"].AXFR; a == nil || a.Status != axfrRefused || a.Rcode != dns.RcodeRefused {
+		t.Errorf("AXFR from 127.0.0.3 = %+v, want refused", a)
+	}
+}
+
+func TestCheckNSTargets(t *testing.T) {
+	setupTestRoot(t)
+	savedAliases := nsAliases
+	nsAliases = cache.New[string]()
+	t.Cleanup(func() { nsAliases = savedAliases })
+
+	startTestServer(t, "127.0.0.3", zoneHandler(t, `
+test. 3600 IN SOA ns.test. hostmaster.test. 1 3600 600 86400 300
+test. 3600 IN NS ns.test.
+ns.test. 3600 IN A 127.0.0.3
+alias.test. 3600 IN CNAME ns.test.
+`))
+
+	for name, valid := range map[string]bool{"ns1.example.test": true, "ns1.example.test.": true, "ns_1.example.test": false, "-ns.example.test": false, "ns..test": false, strings.Repeat("a", 64) + ".test": false} {
+		if reason := hostnameError(name); (reason == "") != valid {
+			t.Errorf("hostnameError(%q) = %q, want valid: %t", name, reason, valid)
+		}
+	}
+	// an IP literal, an invalid hostname and an alias
+	if found := checkNSTargets("example.test", []string{"ns.test", "192.0.2.1", "ns_1.example.test", "alias.test"}); found != 3 {
+		t.Errorf("checkNSTargets() = %d, want 3", found)
+	}
+	if target, _ := nsAliases.Get("alias.test"); target != "ns.test" {
+		t.Errorf("alias of alias.test = %q, want ns.test", target)
+	}
+}
+
+func TestFingerprints(t *testing.T) {
+	fps, err := loadFingerprints("fingerprints.txt")
+	if err != nil || len(fps) == 0 {
+		t.Fatalf("loadFingerprints() = %d fingerprints, error: %v", len(fps), err)
+	}
+	if _, err := parseFingerprints(strings.NewReader("provider ns*.example.net TIMEOUT\n"), "test"); err == nil {
+		t.Errorf("parseFingerprints() with an unknown response did not fail")
+	}
+
+	saved := fingerprints
+	fingerprints, err = parseFingerprints(strings.NewReader(`# test providers
+example-dns ns*.example-dns.test,dns.example-dns.test REFUSED,SERVFAIL
+`), "test")
+	if err != nil {
+		t.Fatalf("parseFingerprints() error: %s", err)
+	}
+	t.Cleanup(func() { fingerprints = saved })
+
+	for _, tc := range []struct {
+		nameserver string
+		kinds      []string
+		want       bool
+	}{
+		{"ns1.example-dns.test", []string{lameRefused}, true},
+		{"dns.example-dns.test", []string{lameRefused, lameServFail}, true},
+		{"ns1.example-dns.test", []string{lameRefused, lameNXDomain}, false},
+		{"ns1.example-dns.test", nil, false},
+		{"ns1.other.test", []string{lameRefused}, false},
+	} {
+		if fp := matchFingerprint(tc.nameserver, tc.kinds); (fp != nil) != tc.want {
+			t.Errorf("matchFingerprint(%q, %v) = %v, want match: %t", tc.nameserver, tc.kinds, fp, tc.want)
+		}
+	}
+}
+
+// testKey generates a KSK for zone
+func testKey(t *testing.T, zone string) (*dns.DNSKEY, crypto.Signer) {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: dns.Fqdn(zone), Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("Generate() error: %s", err)
+	}
+	return key, priv.(crypto.Signer)
+}
+
+// testSign signs rrset with key, valid from inception to expiration
+func testSign(t *testing.T, key *dns.DNSKEY, priv crypto.Signer, rrset []dns.RR, inception, expiration time.Time) *dns.RRSIG {
+	t.Helper()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: 3600},
+		Algorithm:  key.Algorithm,
+		SignerName: key.Hdr.Name,
+		KeyTag:     key.KeyTag(),
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(expiration.Unix()),
+	}
+	if err := sig.Sign(priv, rrset); err != nil {
+		t.Fatalf("Sign() error: %s", err)
+	}
+	return sig
+}
+
+// typeHandler answers authoritatively with the records of the question type and their signatures
+func typeHandler(rrs ...dns.RR) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		for _, rr := range rrs {
+			if sig, ok := rr.(*dns.RRSIG); (ok && sig.TypeCovered == r.Question[0].Qtype) || rr.Header().Rrtype == r.Question[0].Qtype {
+				m.Answer = append(m.Answer, rr)
+			}
+		}
+		w.WriteMsg(m)
+	}
+}
+
+func TestCheckDNSSEC(t *testing.T) {
+	setupTestEnv(t)
+	savedKeys := zoneKeys
+	zoneKeys = cache.New[[]*dns.DNSKEY]()
+	t.Cleanup(func() { zoneKeys = savedKeys })
+
+	ksk, priv := testKey(t, "example.test")
+	other, _ := testKey(t, "example.test")
+	sign := func(rrset []dns.RR, inception, expiration time.Time) *dns.RRSIG {
+		return testSign(t, ksk, priv, rrset, inception, expiration)
+	}
+	ds := ksk.ToDS(dns.SHA256)
+	ds.Hdr = dns.RR_Header{Name: "example.test.", Rrtype: dns.TypeDS, Class: dns.ClassINET, Ttl: 3600}
+	now := time.Now()
+	// 127.0.0.3 is signed properly, 127.0.0.4 has another key and an expired signature
+	startTestServer(t, "127.0.0.2", typeHandler(ds))
+	startTestServer(t, "127.0.0.3", typeHandler(ksk, sign([]dns.RR{ksk}, now.Add(-time.Hour), now.Add(time.Hour))))
+	startTestServer(t, "127.0.0.4", typeHandler(ksk, other, sign([]dns.RR{ksk, other}, now.Add(-2*time.Hour), now.Add(-time.Hour))))
+
+	parent := &queryGroup{
+		Domain: "example.test",
+		Results: map[string]*queryResult{
+			"ns.test": {Addrs: map[string]*queryResult{"127.0.0.2": {NS: []string{"ns1.example.test"}, NSOwner: "example.test", NSSection: sectionAuthority}}},
+		},
+	}
+	group := testAuthGroup("example.test", "127.0.0.3", "127.0.0.4")
+	if found := checkDNSSEC(parent, group); found != 2 {
+		t.Errorf("checkDNSSEC() = %d, want 2", found)
+	}
+	if keys := group.Results["ns1.example.test"].Addrs["127.0.0.4"].DNSKEY; len(keys) != 2 {
+		t.Errorf("DNSKEY from 127.0.0.4 = %v, want 2 keys", keys)
+	}
+
+	// a DS for a key that is not published, and one whose digest does not match
+	bad := ksk.ToDS(dns.SHA256)
+	bad.Digest = strings.Repeat("00", 32)
+	if matched, problems := dsKeys([]*dns.DS{other.ToDS(dns.SHA256), bad}, []*dns.DNSKEY{ksk}); len(matched) != 0 || len(problems) != 2 {
+		t.Errorf("dsKeys() = %v, %v, want no matches and 2 problems", matched, problems)
+	}
+}
+
+func TestCheckCDS(t *testing.T) {
+	setupTestEnv(t)
+	ksk, priv := testKey(t, "example.test")
+	other, _ := testKey(t, "example.test")
+	now := time.Now()
+	sign := func(rrs ...dns.RR) *dns.RRSIG {
+		return testSign(t, ksk, priv, rrs, now.Add(-time.Hour), now.Add(time.Hour))
+	}
+	cds := func(key *dns.DNSKEY) *dns.CDS {
+		c := key.ToDS(dns.SHA256).ToCDS()
+		c.Hdr.Name = "example.test."
+		return c
+	}
+	cds384 := func(key *dns.DNSKEY) *dns.CDS {
+		c := key.ToDS(dns.SHA384).ToCDS()
+		c.Hdr.Name = "example.test."
+		return c
+	}
+	cdnskey := func(key *dns.DNSKEY) *dns.CDNSKEY {
+		c := key.ToCDNSKEY()
+		c.Hdr.Name = "example.test."
+		return c
+	}
+	deleteCDS := &dns.CDS{DS: dns.DS{Hdr: dns.RR_Header{Name: "example.test.", Rrtype: dns.TypeCDS, Class: dns.ClassINET, Ttl: 3600}, Digest: "00"}}
+
+	good := []dns.RR{ksk, sign(ksk), cds(ksk), sign(cds(ksk)), cdnskey(ksk), sign(cdnskey(ksk))}
+	for _, tc := range []struct {
+		name string
+		rrs  []dns.RR
+		want uint
+	}{
+		{"consistent", good, 0},
+		// the second server publishes a CDS for a key that is not in the DNSKEY set, without a CDNSKEY for it,
+		// and no CDS for the key of its CDNSKEY
+		{"mismatch", []dns.RR{ksk, sign(ksk), cds(other), sign(cds(other)), cdnskey(ksk), sign(cdnskey(ksk))}, 4},
+		// the second server publishes a CDS for each of 2 digest types of the same key, which only differs from the first
+		{"digests", []dns.RR{ksk, sign(ksk), cds(ksk), cds384(ksk), sign(cds(ksk), cds384(ksk)), cdnskey(ksk), sign(cdnskey(ksk))}, 1},
+		// the second server asks for the DS to be removed
+		{"delete", []dns.RR{ksk, sign(ksk), deleteCDS, sign(deleteCDS)}, 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			startTestServer(t, "127.0.0.2", typeHandler(good...))
+			startTestServer(t, "127.0.0.3", typeHandler(tc.rrs...))
+			group := testAuthGroup("example.test", "127.0.0.2", "127.0.0.3")
+			if found := checkCDS(group); found != tc.want {
+				t.Errorf("checkCDS() = %d, want %d", found, tc.want)
+			}
+		})
+	}
+}
+
+func TestCheckChildOnly(t *testing.T) {
+	setupTestEnv(t)
+	ns := func(hosts ...string) dns.HandlerFunc {
+		return func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			if len(hosts) == 0 {
+				m.Rcode = dns.RcodeRefused
+			}
+			m.Authoritative = len(hosts) > 0
+			for _, host := range hosts {
+				m.Answer = append(m.Answer, &dns.NS{Hdr: dns.RR_Header{Name: "example.test.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600}, Ns: host})
+			}
+			w.WriteMsg(m)
+		}
+	}
+	// the parent only delegates to ns1, ns1 adds ns2 which adds ns3, and ns3 is lame
+	startTestServer(t, "127.0.0.2", ns("ns1.example.test.", "ns2.example.test."))
+	startTestServer(t, "127.0.0.3", ns("ns1.example.test.", "ns2.example.test.", "ns3.example.test."))
+	startTestServer(t, "127.0.0.4", ns())
+	for i, host := range []string{"ns1.example.test", "ns2.example.test", "ns3.example.test"} {
+		nsAddrs.Add(host, net.IPv4(127, 0, 0, byte(i+2)))
+	}
+
+	lame, auth := checkLame(&queryGroup{Domain: "example.test", NS: []string{"ns1.example.test"}})
+	if !lame.Lame || auth == nil {
+		t.Fatalf("checkLame() = %+v, %v, want lame with authoritative results", lame, auth)
+	}
+	for host, childOnly := range map[string]bool{"ns1.example.test": false, "ns2.example.test": true, "ns3.example.test": true} {
+		if r, ok := auth.Results[host]; !ok || r.ChildOnly != childOnly {
+			t.Errorf("result for %q = %v, want child-only: %t", host, r, childOnly)
+		}
+	}
+	if r := auth.Results["ns3.example.test"].Addrs["127.0.0.4"]; r == nil || r.Rcode != dns.RcodeRefused {
+		t.Errorf("result for ns3.example.test [127.0.0.4] = %v, want REFUSED", r)
+	}
+}
+
+func TestCheckNSAddrs(t *testing.T) {
+	savedDenied, savedAllowed := deniedRanges, allowedRanges
+	t.Cleanup(func() { deniedRanges, allowedRanges = savedDenied, savedAllowed })
+	var err error
+	if deniedRanges, err = parseCIDRs("8.8.8.0/24", "denied"); err != nil {
+		t.Fatalf("parseCIDRs() error: %s", err)
+	}
+	allowedRanges = mustParseRanges(map[string]string{"10.1.0.0/16": "allowed"})
+
+	for addr, want := range map[string]string{
+		"10.0.0.1":    "Private-Use",
+		"10.1.0.1":    "",
+		"127.0.0.1":   "Loopback",
+		"0.0.0.0":     "This network",
+		"192.0.2.53":  "Documentation (TEST-NET-1)",
+		"8.8.8.8":     "denied",
+		"1.1.1.1":     "",
+		"::1":         "Loopback Address",
+		"fd00::53":    "Unique-Local",
+		"2001:db8::1": "Documentation",
+		"2606:4700::": "",
+		// globally reachable anycast inside IETF Protocol Assignments
+		"192.0.0.8":  "IETF Protocol Assignments",
+		"192.0.0.9":  "",
+		"192.0.0.10": "",
+		"2001::1":    "IETF Protocol Assignments",
+		"2001:1::1":  "",
+		"2001:2::1":  "Benchmarking",
+	} {
+		name := ""
+		if r := addrRangeOf(net.ParseIP(addr)); r != nil {
+			name = r.Name
+		}
+		if name != want {
+			t.Errorf("addrRangeOf(%s) = %q, want %q", addr, name, want)
+		}
+	}
+
+	parent := &queryGroup{
+		Domain: "example.test",
+		Results: map[string]*queryResult{
+			"ns.test": {Addrs: map[string]*queryResult{"192.0.2.1": {NS: []string{"ns1.example.test"}, NSOwner: "example.test", NSSection: sectionAuthority,
+				Glue: map[string][]net.IP{"ns1.example.test": {net.ParseIP("10.0.0.1")}}}}},
+		},
+	}
+	auth := &queryGroup{
+		Domain: "example.test",
+		Results: map[string]*queryResult{
+			"ns1.example.test": {Addrs: map[string]*queryResult{"10.0.0.1": {}}},
+			"ns2.example.net":  {Addrs: map[string]*queryResult{"127.0.0.1": {}, "1.1.1.1": {}}},
+		},
+	}
+	if found := checkNSAddrs(parent, auth); found != 2 {
+		t.Errorf("checkNSAddrs() = %d, want 2", found)
+	}
+}
+
+func TestFindNSCycles(t *testing.T) {
+	setupTestRoot(t)
+	savedDeps, savedZones := deps, nsHostZones
+	t.Cleanup(func() { deps, nsHostZones = savedDeps, savedZones })
+	deps, nsHostZones = newDependencies(), cache.New[[]string]()
+	startTestServer(t, "127.0.0.3", zoneHandler(t, `
+test. 3600 IN SOA ns.test. hostmaster.test. 1 3600 600 86400 300
+test. 3600 IN NS ns.test.
+ns.test. 3600 IN A 127.0.0.3
+a.test. 3600 IN NS ns.b.test.
+b.test. 3600 IN NS ns.a.test.
+c.test. 3600 IN NS ns.c.test.
+ns.c.test. 3600 IN A 127.0.0.4
+`))
+
+	walkNSHostZones([]string{"ns.a.test", "ns.b.test", "ns.c.test"})
+	if cuts, _ := nsHostZones.Get("ns.b.test"); !StringArrayEquals(cuts, []string{"test", "b.test"}) {
+		t.Errorf("zone cuts for ns.b.test = %v, want [test b.test]", cuts)
+	}
+	// d.test only has a nameserver in the cycle, e.test also has one with glue
+	deps.AddDelegation("d.test", []string{"ns.a.test"}, nil)
+	deps.AddDelegation("e.test", []string{"ns.a.test", "ns.c.test"}, nil)
+
+	cycles := findNSCycles(deps.Delegations(), nsHostZones.Get)
+	if len(cycles) != 1 {
+		t.Fatalf("findNSCycles() = %v, want 1 cycle", cycles)
+	}
+	if got, want := cycles[0].String(), "a.test NS ns.b.test -> b.test NS ns.a.test -> a.test"; got != want {
+		t.Errorf("findNSCycles() cycle = %q, want %q", got, want)
+	}
+	if !StringArrayEquals(cycles[0].Affected, []string{"a.test", "b.test", "d.test"}) {
+		t.Errorf("findNSCycles() affected = %v, want [a.test b.test d.test]", cycles[0].Affected)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// ttlPolicy holds the bounds NS TTLs are checked against
+type ttlPolicy struct {
+	Min   time.Duration // lowest allowed TTL of the authoritative NS records
+	Max   time.Duration // highest allowed TTL of the authoritative NS records
+	Ratio float64       // largest allowed ratio between the parent and authoritative TTLs, 0 to not compare them
+}
+
+// the parent and authoritative TTLs are not compared by default, registries commonly use long referral TTLs,
+// ex: 2 days for .com, while the zones themselves use a few hours
+var nsTTLPolicy = ttlPolicy{Min: 5 * time.Minute, Max: 7 * 24 * time.Hour}
+
+func (p ttlPolicy) validate() error {
+	if p.Min < 0 || p.Max < 0 || p.Ratio < 0 {
+		return fmt.Errorf("NS TTL bounds can not be negative")
+	}
+	if p.Max != 0 && p.Min > p.Max {
+		return fmt.Errorf("NS TTL min %s is above max %s", p.Min, p.Max)
+	}
+	return nil
+}
+
+func ttlDuration(ttl uint32) time.Duration {
+	return time.Duration(ttl) * time.Second
+}
+
+// checkNSTTL compares the TTL of the NS records in the referrals from the parent with the authoritative answers,
+// and checks the authoritative TTLs against nsTTLPolicy
+func checkNSTTL(parent, auth *queryGroup) uint {
+	var found uint = 0
+
+	// the parent TTL, only from referrals
+	var parentTTL uint32 = 0
+	for _, result := range parent.Results {
+		for _, r := range result.Addrs {
+			if r.Err == nil && !r.Authoritative && r.NSSection == sectionAuthority && r.NSTTL > parentTTL {
+				parentTTL = r.NSTTL
+			}
+		}
+	}
+
+	// the authoritative TTLs, and which addresses answered with each
+	ttls := make(map[uint32][]string)
+	for server, result := range auth.Results {
+		for addr, r := range result.Addrs {
+			if kind, _ := classifyLame(r, auth.Domain); kind == "" {
+				ttls[r.NSTTL] = append(ttls[r.NSTTL], serverAddr(server, addr))
+			}
+		}
+	}
+	if len(ttls) == 0 {
+		return found
+	}
+	values := make([]uint32, 0, len(ttls))
+	for ttl := range ttls {
+		values = append(values, ttl)
+		sort.Strings(ttls[ttl])
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	if len(values) > 1 {
+		variants := make([]string, 0, len(values))
+		for _, ttl := range values {
+			variants = append(variants, fmt.Sprintf("%s from %v", ttlDuration(ttl), ttls[ttl]))
+		}
+		finding("NS TTL differs between servers: %q: %v", auth.Domain, variants)
+		found++
+	}
+
+	for _, ttl := range values {
+		d := ttlDuration(ttl)
+		if d < nsTTLPolicy.Min || (nsTTLPolicy.Max != 0 && d > nsTTLPolicy.Max) {
+			finding("NS TTL out of bounds: %q TTL %s from %v, allowed %s to %s", auth.Domain, d, ttls[ttl], nsTTLPolicy.Min, nsTTLPolicy.Max)
+			found++
+		}
+	}
+
+	if parentTTL > 0 && nsTTLPolicy.Ratio > 0 {
+		for _, ttl := range values {
+			ratio := math.Max(float64(parentTTL), float64(ttl)) / math.Max(1, math.Min(float64(parentTTL), float64(ttl)))
+			if ratio > nsTTLPolicy.Ratio {
+				finding("NS TTL mismatch: %q parent TTL %s, authoritative TTL %s from %v", auth.Domain, ttlDuration(parentTTL), ttlDuration(ttl), ttls[ttl])
+				found++
+			}
+		}
+	}
+	return found
+}
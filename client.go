@@ -0,0 +1,222 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// clientConfig holds the settings used to send queries to nameservers
+type clientConfig struct {
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	Retries      uint          // times a failed query is sent again
+	Backoff      time.Duration // wait before the first retry, doubled for every later retry
+	UDPSize      uint16        // EDNS0 UDP buffer size to advertise, 0 sends queries without EDNS0
+	Source       []net.IP      // local addresses to send from, at most one per address family
+	Interface    string        // local interface to send from, used when Source is empty
+}
+
+// clientProfiles are starting points for different networks, any client flags override them
+var clientProfiles = map[string]clientConfig{
+	"default": {
+		DialTimeout:  10 * time.Second,
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		Retries:      2,
+		Backoff:      time.Second,
+	},
+	"slow": {
+		DialTimeout:  30 * time.Second,
+		ReadTimeout:  30 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		Retries:      4,
+		Backoff:      2 * time.Second,
+	},
+	"datacenter": {
+		DialTimeout:  2 * time.Second,
+		ReadTimeout:  2 * time.Second,
+		WriteTimeout: 2 * time.Second,
+		Retries:      1,
+		Backoff:      200 * time.Millisecond,
+	},
+}
+
+type clientKey struct {
+	transport string
+	family    string
+}
+
+var clientCfg clientConfig
+var dnsClients map[clientKey]*dns.Client
+
+func init() {
+	check(setClientConfig(clientProfiles["default"]))
+}
+
+// clientOverrides are the client settings given on the command line, the ones that are set replace the profile's
+type clientOverrides struct {
+	DialTimeout  *time.Duration
+	ReadTimeout  *time.Duration
+	WriteTimeout *time.Duration
+	Retries      *uint
+	Backoff      *time.Duration
+}
+
+// profileConfig returns the named profile with the overrides applied
+func profileConfig(name string, o clientOverrides) (clientConfig, error) {
+	cfg, ok := clientProfiles[name]
+	if !ok {
+		return cfg, fmt.Errorf("unknown profile %q", name)
+	}
+	if o.DialTimeout != nil {
+		cfg.DialTimeout = *o.DialTimeout
+	}
+	if o.ReadTimeout != nil {
+		cfg.ReadTimeout = *o.ReadTimeout
+	}
+	if o.WriteTimeout != nil {
+		cfg.WriteTimeout = *o.WriteTimeout
+	}
+	if o.Retries != nil {
+		cfg.Retries = *o.Retries
+	}
+	if o.Backoff != nil {
+		cfg.Backoff = *o.Backoff
+	}
+	return cfg, cfg.validate()
+}
+
+// validate checks the settings that do not depend on the local network
+func (cfg clientConfig) validate() error {
+	if cfg.DialTimeout <= 0 || cfg.ReadTimeout <= 0 || cfg.WriteTimeout <= 0 {
+		return fmt.Errorf("dial, read and write timeouts must be positive")
+	}
+	if cfg.Retries > 10 {
+		return fmt.Errorf("retries must be 10 or less, got %d", cfg.Retries)
+	}
+	if cfg.Backoff < 0 {
+		return fmt.Errorf("backoff can not be negative")
+	}
+	if cfg.UDPSize != 0 && cfg.UDPSize < dns.MinMsgSize {
+		return fmt.Errorf("EDNS0 UDP size must be 0 or at least %d, got %d", dns.MinMsgSize, cfg.UDPSize)
+	}
+	return nil
+}
+
+// setClientConfig validates the config and builds the clients used by exchange from it
+func setClientConfig(cfg clientConfig) error {
+	if err := cfg.validate(); err != nil {
+		return err
+	}
+
+	source := make(map[string]net.IP)
+	for _, ip := range cfg.Source {
+		if _, ok := source[ipFamily(ip)]; ok {
+			return fmt.Errorf("only one %s source address can be used", ipFamily(ip))
+		}
+		source[ipFamily(ip)] = ip
+	}
+	if len(cfg.Source) == 0 && cfg.Interface != "" {
+		var err error
+		source, err = interfaceAddrs(cfg.Interface)
+		if err != nil {
+			return err
+		}
+	}
+
+	clients := make(map[clientKey]*dns.Client)
+	for _, family := range []string{familyIPv4, familyIPv6} {
+		for _, transport := range []string{transportUDP, transportTCP, transportTLS} {
+			client := &dns.Client{
+				Net:          transport,
+				UDPSize:      cfg.UDPSize,
+				DialTimeout:  cfg.DialTimeout,
+				ReadTimeout:  cfg.ReadTimeout,
+				WriteTimeout: cfg.WriteTimeout,
+			}
+			if transport == transportTLS {
+				client.Net = "tcp-tls"
+				// authoritative DNS over TLS is opportunistic, certificates are not verified, RFC 9539
+				client.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+			}
+			if ip, ok := source[family]; ok {
+				client.Dialer = &net.Dialer{Timeout: cfg.DialTimeout}
+				if transport != transportUDP {
+					client.Dialer.LocalAddr = &net.TCPAddr{IP: ip}
+				} else {
+					client.Dialer.LocalAddr = &net.UDPAddr{IP: ip}
+				}
+			}
+			clients[clientKey{transport, family}] = client
+		}
+	}
+
+	clientCfg = cfg
+	dnsClients = clients
+	return nil
+}
+
+// interfaceAddrs returns the first usable address of each family on the named interface
+func interfaceAddrs(name string) (map[string]net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]net.IP)
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if _, ok := out[ipFamily(ipNet.IP)]; !ok {
+			out[ipFamily(ipNet.IP)] = ipNet.IP
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no usable addresses on interface %q", name)
+	}
+	return out, nil
+}
+
+// withServerName returns a copy of a TLS client that sends server as the SNI
+func withServerName(c *dns.Client, server string) *dns.Client {
+	out := &dns.Client{
+		Net:          c.Net,
+		UDPSize:      c.UDPSize,
+		DialTimeout:  c.DialTimeout,
+		ReadTimeout:  c.ReadTimeout,
+		WriteTimeout: c.WriteTimeout,
+		Dialer:       c.Dialer,
+		TLSConfig:    c.TLSConfig.Clone(),
+	}
+	out.TLSConfig.ServerName = server
+	return out
+}
+
+// client returns the client to send a query to ip over transport
+func client(transport string, ip net.IP) *dns.Client {
+	return dnsClients[clientKey{transport, ipFamily(ip)}]
+}
@@ -0,0 +1,57 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProfileConfig(t *testing.T) {
+	duration := func(d time.Duration) *time.Duration { return &d }
+	count := func(n uint) *uint { return &n }
+
+	for _, tc := range []struct {
+		name      string
+		profile   string
+		overrides clientOverrides
+		want      clientConfig // compared when there is no error
+		wantErr   bool
+	}{
+		{"default", "default", clientOverrides{}, clientProfiles["default"], false},
+		{"unknown profile", "fast", clientOverrides{}, clientConfig{}, true},
+		{
+			"flags override the profile", "datacenter",
+			clientOverrides{ReadTimeout: duration(5 * time.Second), WriteTimeout: duration(3 * time.Second), Retries: count(0)},
+			clientConfig{DialTimeout: 2 * time.Second, ReadTimeout: 5 * time.Second, WriteTimeout: 3 * time.Second, Retries: 0, Backoff: 200 * time.Millisecond},
+			false,
+		},
+		{"zero dial timeout", "default", clientOverrides{DialTimeout: duration(0)}, clientConfig{}, true},
+		{"negative write timeout", "slow", clientOverrides{WriteTimeout: duration(-time.Second)}, clientConfig{}, true},
+		{"negative backoff", "default", clientOverrides{Backoff: duration(-time.Second)}, clientConfig{}, true},
+		{"too many retries", "default", clientOverrides{Retries: count(11)}, clientConfig{}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg, err := profileConfig(tc.profile, tc.overrides)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("profileConfig(%q) error: %v, want error: %t", tc.profile, err, tc.wantErr)
+			}
+			if err == nil && (cfg.DialTimeout != tc.want.DialTimeout || cfg.ReadTimeout != tc.want.ReadTimeout ||
+				cfg.WriteTimeout != tc.want.WriteTimeout || cfg.Retries != tc.want.Retries || cfg.Backoff != tc.want.Backoff) {
+				t.Errorf("profileConfig(%q) = %+v, want %+v", tc.profile, cfg, tc.want)
+			}
+		})
+	}
+}
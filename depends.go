@@ -0,0 +1,126 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// dependencies records which nameserver hosts every zone was seen with, and which zones every input name was walked through,
+// so that findings about a single nameserver host can list every input name that depends on it
+type dependencies struct {
+	m           sync.RWMutex
+	zoneHosts   map[string]map[string]bool
+	inputZones  map[string][]string
+	delegations map[string]delegation
+}
+
+// delegation is a zone cut as given in the referral from the parent
+type delegation struct {
+	Hosts []string
+	Glue  map[string]bool // hosts the referral has glue for
+}
+
+var deps = newDependencies()
+
+func newDependencies() *dependencies {
+	var d dependencies
+	d.zoneHosts = make(map[string]map[string]bool)
+	d.inputZones = make(map[string][]string)
+	d.delegations = make(map[string]delegation)
+	return &d
+}
+
+// AddZone records nameserver hosts seen for zone, from the parent or the zone itself
+func (d *dependencies) AddZone(zone string, hosts ...string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if d.zoneHosts[zone] == nil {
+		d.zoneHosts[zone] = make(map[string]bool)
+	}
+	for _, host := range hosts {
+		d.zoneHosts[zone][host] = true
+	}
+}
+
+// AddDelegation records the nameserver hosts and glue in the referral from the parent of zone, keeping the first one seen
+func (d *dependencies) AddDelegation(zone string, hosts []string, glue map[string]bool) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	if _, ok := d.delegations[zone]; !ok {
+		d.delegations[zone] = delegation{Hosts: hosts, Glue: glue}
+	}
+}
+
+// Delegation returns the referral recorded for zone
+func (d *dependencies) Delegation(zone string) (delegation, bool) {
+	d.m.RLock()
+	defer d.m.RUnlock()
+	z, ok := d.delegations[zone]
+	return z, ok
+}
+
+// Delegations returns a copy of every referral recorded
+func (d *dependencies) Delegations() map[string]delegation {
+	d.m.RLock()
+	defer d.m.RUnlock()
+	out := make(map[string]delegation, len(d.delegations))
+	for zone, z := range d.delegations {
+		out[zone] = z
+	}
+	return out
+}
+
+// AddInput records the names walked through to check the input name
+func (d *dependencies) AddInput(name string, zones []string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.inputZones[name] = zones
+}
+
+// InputsUsing returns every input name that has host as a nameserver of itself or any of its parents
+func (d *dependencies) InputsUsing(host string) []string {
+	d.m.RLock()
+	defer d.m.RUnlock()
+	out := make([]string, 0)
+	for name, zones := range d.inputZones {
+		for _, zone := range zones {
+			if d.zoneHosts[zone][host] {
+				out = append(out, name)
+				break
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// InputsThrough returns every input name that was walked through zone
+func (d *dependencies) InputsThrough(zone string) []string {
+	d.m.RLock()
+	defer d.m.RUnlock()
+	out := make([]string, 0)
+	for name, zones := range d.inputZones {
+		for _, z := range zones {
+			if z == zone {
+				out = append(out, name)
+				break
+			}
+		}
+	}
+	sort.Strings(out)
+	return out
+}
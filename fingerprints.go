@@ -0,0 +1,118 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// responses a fingerprint can expect, mapped to the kinds of lameness from classifyLame
+var fingerprintKinds = map[string]string{
+	"REFUSED":     lameRefused,
+	"SERVFAIL":    lameServFail,
+	"NXDOMAIN":    lameNXDomain,
+	"NOTAUTH":     lameNotAuthoritative,
+	"REFERRAL":    lameReferral,
+	"UPREFERRAL":  lameUpwardReferral,
+	"NONS":        lameNoNS,
+	"UNREACHABLE": lameUnreachable,
+}
+
+// fingerprint matches the nameservers of a hosted DNS provider, and the responses they give for zones they do not host
+type fingerprint struct {
+	Provider string
+	Patterns []string        // nameserver host patterns, * matches any characters
+	Kinds    map[string]bool // kinds of lameness from classifyLame
+}
+
+// fingerprints are loaded from -fingerprints
+var fingerprints []*fingerprint
+
+// loadFingerprints reads a fingerprint file, see parseFingerprints
+func loadFingerprints(file string) ([]*fingerprint, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseFingerprints(f, file)
+}
+
+// parseFingerprints parses lines of "provider pattern[,pattern] response[,response]", ex:
+// example-dns ns*.example-dns.net REFUSED,SERVFAIL
+// the text after a # is a comment
+func parseFingerprints(r io.Reader, file string) ([]*fingerprint, error) {
+	var out []*fingerprint
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.Fields(strings.SplitN(scanner.Text(), "#", 2)[0])
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected provider, nameserver patterns and responses, got %q", file, line, scanner.Text())
+		}
+		fp := &fingerprint{Provider: fields[0], Kinds: make(map[string]bool)}
+		for _, pattern := range strings.Split(fields[1], ",") {
+			pattern = cleanDomain(pattern)
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid pattern %q: %w", file, line, pattern, err)
+			}
+			fp.Patterns = append(fp.Patterns, pattern)
+		}
+		for _, response := range strings.Split(fields[2], ",") {
+			kind, ok := fingerprintKinds[strings.ToUpper(response)]
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: unknown response %q", file, line, response)
+			}
+			fp.Kinds[kind] = true
+		}
+		out = append(out, fp)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// matchFingerprint returns the fingerprint of the provider of nameserver if every kind of lameness it showed is one the
+// provider gives for zones it does not host, or nil if there is none
+func matchFingerprint(nameserver string, kinds []string) *fingerprint {
+	if len(kinds) == 0 {
+		return nil
+	}
+	for _, fp := range fingerprints {
+		for _, pattern := range fp.Patterns {
+			if ok, _ := path.Match(pattern, nameserver); !ok {
+				continue
+			}
+			matched := true
+			for _, kind := range kinds {
+				matched = matched && fp.Kinds[kind]
+			}
+			if matched {
+				return fp
+			}
+		}
+	}
+	return nil
+}
@@ -4,10 +4,8 @@ go 1.18
 
 require (
 	github.com/miekg/dns v1.1.43
+	golang.org/x/net v0.0.0-20211101193420-4a448f8816b3
 	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
 )
 
-require (
-	golang.org/x/net v0.0.0-20211101193420-4a448f8816b3 // indirect
-	golang.org/x/sys v0.0.0-20211102192858-4dd72447c267 // indirect
-)
+require golang.org/x/sys v0.0.0-20211102192858-4dd72447c267 // indirect
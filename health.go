@@ -0,0 +1,151 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is wrapped by the error returned for queries that were not sent because the server kept failing
+var errCircuitOpen = errors.New("circuit open")
+
+// healthTable tracks failures of every nameserver address, and opens a circuit for an address once it fails
+// threshold times in a row so that later queries return an unreachable result right away instead of timing out.
+// Once cooldown has passed a single query is let through to probe the server again.
+type healthTable struct {
+	m         sync.Mutex
+	servers   map[healthKey]*serverHealth
+	threshold uint
+	cooldown  time.Duration
+}
+
+type healthKey struct {
+	addr      string
+	transport string
+}
+
+type serverHealth struct {
+	names          map[string]bool
+	failures       uint // consecutive failures
+	totalFailures  uint
+	opened         uint // times the circuit was opened
+	shortCircuited uint
+	openedAt       time.Time // zero when the circuit is closed
+	probing        bool
+	lastErr        error
+}
+
+var health = newHealthTable(5, 5*time.Minute)
+
+// newHealthTable creates a health table, a threshold of 0 disables the circuit breaker
+func newHealthTable(threshold uint, cooldown time.Duration) *healthTable {
+	var h healthTable
+	h.servers = make(map[healthKey]*serverHealth)
+	h.threshold = threshold
+	h.cooldown = cooldown
+	return &h
+}
+
+func (h *healthTable) get(key healthKey, server string) *serverHealth {
+	s, ok := h.servers[key]
+	if !ok {
+		s = &serverHealth{names: make(map[string]bool)}
+		h.servers[key] = s
+	}
+	if server != "" {
+		s.names[server] = true
+	}
+	return s
+}
+
+// Allow returns nil if a query may be sent to the address, or an error wrapping errCircuitOpen if it may not
+func (h *healthTable) Allow(server, addr, transport string) error {
+	if h.threshold == 0 {
+		return nil
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	s := h.get(healthKey{addr, transport}, server)
+	if s.openedAt.IsZero() {
+		return nil
+	}
+	if !s.probing && time.Since(s.openedAt) >= h.cooldown {
+		// half open, let this query through to test the server
+		s.probing = true
+		return nil
+	}
+	s.shortCircuited++
+	return fmt.Errorf("%w for %s after %d failures, last error: %s", errCircuitOpen, serverAddr(server, addr), s.failures, s.lastErr)
+}
+
+// Record updates the health of the address with the result of a query
+func (h *healthTable) Record(server, addr, transport string, err error) {
+	if h.threshold == 0 {
+		return
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	s := h.get(healthKey{addr, transport}, server)
+	if err == nil {
+		if !s.openedAt.IsZero() {
+			v("circuit closed for %s %s", serverAddr(server, addr), transport)
+		}
+		s.failures = 0
+		s.openedAt = time.Time{}
+		s.probing = false
+		return
+	}
+
+	s.failures++
+	s.totalFailures++
+	s.lastErr = err
+	switch {
+	case s.probing:
+		// probe failed, wait another cooldown
+		s.openedAt = time.Now()
+		s.probing = false
+	case s.openedAt.IsZero() && s.failures >= h.threshold:
+		v("circuit opened for %s %s after %d failures: %s", serverAddr(server, addr), transport, s.failures, err)
+		s.openedAt = time.Now()
+		s.opened++
+	}
+}
+
+// String reports every address that had its circuit opened during the run
+func (h *healthTable) String() string {
+	h.m.Lock()
+	defer h.m.Unlock()
+	lines := make([]string, 0)
+	for key, s := range h.servers {
+		if s.opened == 0 {
+			continue
+		}
+		state := "closed"
+		if !s.openedAt.IsZero() {
+			state = "open"
+		}
+		names := stringMapToArrayKeys(s.names)
+		sort.Strings(names)
+		lines = append(lines, fmt.Sprintf("BREAKER: %s %s %v state: %s, opened %d times, %d failures, %d short-circuited queries, last error: %v",
+			key.addr, key.transport, names, state, s.opened, s.totalFailures, s.shortCircuited, s.lastErr))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,55 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestHealthTable(t *testing.T) {
+	h := newHealthTable(2, time.Hour)
+	server, addr := "ns1.example.test", "192.0.2.1"
+	timeout := errors.New("i/o timeout")
+
+	h.Record(server, addr, transportUDP, timeout)
+	if err := h.Allow(server, addr, transportUDP); err != nil {
+		t.Fatalf("Allow() after 1 failure = %v, want nil", err)
+	}
+	h.Record(server, addr, transportUDP, timeout)
+	if err := h.Allow(server, addr, transportUDP); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("Allow() after 2 failures = %v, want errCircuitOpen", err)
+	}
+	if err := h.Allow(server, addr, transportTCP); err != nil {
+		t.Errorf("Allow() over another transport = %v, want nil", err)
+	}
+
+	// once the cooldown passed one probe is allowed, and a success closes the circuit
+	h.servers[healthKey{addr, transportUDP}].openedAt = time.Now().Add(-2 * time.Hour)
+	if err := h.Allow(server, addr, transportUDP); err != nil {
+		t.Fatalf("Allow() after cooldown = %v, want nil", err)
+	}
+	if err := h.Allow(server, addr, transportUDP); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("Allow() while probing = %v, want errCircuitOpen", err)
+	}
+	h.Record(server, addr, transportUDP, nil)
+	if err := h.Allow(server, addr, transportUDP); err != nil {
+		t.Errorf("Allow() after successful probe = %v, want nil", err)
+	}
+	if h.String() == "" {
+		t.Errorf("String() is empty, want the breaker that opened")
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// default root hints
+// https://www.iana.org/domains/root/files
+//
+//go:embed named.root
+var defaultRootHints string
+
+// rootServers are the nameservers the delegation walk starts from, their addresses are always in nsAddrs
+var rootServers []string
+
+func init() {
+	hints, err := parseRootHints(strings.NewReader(defaultRootHints), "named.root")
+	check(err)
+	setRootHints(hints)
+}
+
+// rootHints maps the name of each root nameserver to its addresses
+type rootHints map[string][]net.IP
+
+// loadRootHints reads a named.root style hints file
+func loadRootHints(path string) (rootHints, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseRootHints(file, path)
+}
+
+// parseRootHints parses the root NS records and their addresses from a hints file, every server must have an address
+// since the hints are used without any outside resolution
+func parseRootHints(r io.Reader, file string) (rootHints, error) {
+	hints := make(rootHints)
+	addrs := make(map[string][]net.IP)
+
+	zp := dns.NewZoneParser(r, ".", file)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		switch t := rr.(type) {
+		case *dns.NS:
+			if t.Hdr.Name == "." {
+				hints[cleanDomain(t.Ns)] = nil
+			}
+		case *dns.A:
+			addrs[cleanDomain(t.Hdr.Name)] = append(addrs[cleanDomain(t.Hdr.Name)], t.A)
+		case *dns.AAAA:
+			addrs[cleanDomain(t.Hdr.Name)] = append(addrs[cleanDomain(t.Hdr.Name)], t.AAAA)
+		}
+	}
+	if err := zp.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(hints) == 0 {
+		return nil, fmt.Errorf("no root NS records in %s", file)
+	}
+	for server := range hints {
+		if len(addrs[server]) == 0 {
+			return nil, fmt.Errorf("no addresses for root server %q in %s", server, file)
+		}
+		hints[server] = addrs[server]
+	}
+	return hints, nil
+}
+
+// parseRootServers parses a comma-separated list of name=address root servers, ex: ns1.lab=192.0.2.1,ns1.lab=2001:db8::1
+func parseRootServers(list string) (rootHints, error) {
+	hints := make(rootHints)
+	for _, entry := range strings.Split(list, ",") {
+		if entry == "" {
+			continue
+		}
+		name, addr, ok := strings.Cut(entry, "=")
+		ip := net.ParseIP(addr)
+		if !ok || ip == nil {
+			return nil, fmt.Errorf("invalid root server %q, expected name=address", entry)
+		}
+		if _, ok := dns.IsDomainName(name); !ok {
+			return nil, fmt.Errorf("invalid root server name %q", name)
+		}
+		hints[cleanDomain(name)] = append(hints[cleanDomain(name)], ip)
+	}
+	if len(hints) == 0 {
+		return nil, fmt.Errorf("no root servers in %q", list)
+	}
+	return hints, nil
+}
+
+// setRootHints replaces the root servers the walk starts from, and resets the address cache to only hold their addresses
+func setRootHints(hints rootHints) {
+	nsAddrs = newAddrCache()
+	rootServers = make([]string, 0, len(hints))
+	for server, ips := range hints {
+		rootServers = append(rootServers, server)
+		nsAddrs.Add(server, ips...)
+		// the hints are the only source of addresses for the roots
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			if _, _, ok := nsAddrs.Get(server, qtype); !ok {
+				nsAddrs.Set(server, qtype, nil, nil)
+			}
+		}
+	}
+	sort.Strings(rootServers)
+}
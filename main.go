@@ -22,6 +22,7 @@ import (
 	"lame-dns/jobs"
 	"lame-dns/sources"
 	"log"
+	"net"
 	"os"
 	"strings"
 	"time"
@@ -35,6 +36,45 @@ var (
 	verbose  = flag.Bool("verbose", false, "show verbose messages")
 	useLists = flag.String("list", "", "comma-separated list of domain lists")
 	nsSet    = flag.String("expected-ns", "", "comma-separated list of domains which we expect nameservers to be under, findings are logged otherwise")
+	only4    = flag.Bool("4", false, "only query nameservers over IPv4")
+	only6    = flag.Bool("6", false, "only query nameservers over IPv6")
+	tcpCheck = flag.Bool("tcp", false, "also query every authoritative nameserver over TCP and compare with the UDP answer")
+	dotCheck = flag.Bool("dot", false, "also query every authoritative nameserver over DNS over TLS on port 853 and compare with the UDP answer")
+	dotSet   = flag.String("dot-expected", "", "comma-separated list of domains whose nameservers are expected to support DNS over TLS, implies -dot")
+	ednsComp = flag.Bool("edns", false, "run EDNS0 compliance tests against every authoritative nameserver")
+	recCheck = flag.Bool("recursion", false, "send a recursive query for a name outside the zone to every authoritative nameserver to find open resolvers")
+	recName  = flag.String("recursion-name", recursionName, "name to ask for with -recursion, should not be in any zone being checked")
+	axfrChk  = flag.Bool("axfr", false, "try a zone transfer from every authoritative nameserver and the SOA MNAME, and report the ones that allow it")
+	axfrSave = flag.String("axfr-dir", "", "directory to save the zones from open transfers to with -axfr, they are not saved by default")
+	dnssec   = flag.Bool("dnssec", false, "check that the DS from the parent matches a DNSKEY signing the DNSKEY set on every authoritative nameserver")
+	cdsCheck = flag.Bool("cds", false, "check that the CDS and CDNSKEY records on every authoritative nameserver are the same, match the DNSKEY set and are signed")
+	hintFile = flag.String("root-hints", "", "named.root hints file with the names and addresses of the root servers to start from")
+	roots    = flag.String("root-servers", "", "comma-separated list of name=address root servers to start from, for private roots")
+	breakerN = flag.Uint("breaker-failures", 5, "consecutive failures before queries to a nameserver address are skipped, 0 to always query")
+	breakerT = flag.Duration("breaker-cooldown", 5*time.Minute, "time to wait before probing a failing nameserver address again")
+	qps      = flag.Float64("qps", 0, "max queries per second to send in total, 0 for unlimited")
+	qpsAddr  = flag.Float64("server-qps", 20, "max queries per second to send to each nameserver address, lowered automatically when an address starts timing out or refusing queries, 0 for unlimited")
+	profile  = flag.String("profile", "default", "DNS client settings to start from: default, slow or datacenter, -dial-timeout, -read-timeout, -write-timeout, -retries and -backoff override it")
+	dialTO   = flag.Duration("dial-timeout", clientProfiles["default"].DialTimeout, "timeout for connecting to a nameserver")
+	readTO   = flag.Duration("read-timeout", clientProfiles["default"].ReadTimeout, "timeout for reading a response from a nameserver")
+	writeTO  = flag.Duration("write-timeout", clientProfiles["default"].WriteTimeout, "timeout for sending a query to a nameserver")
+	retries  = flag.Uint("retries", clientProfiles["default"].Retries, "times to send a failed query again")
+	backoff  = flag.Duration("backoff", clientProfiles["default"].Backoff, "time to wait before the first retry, doubled for each later retry")
+	udpSize  = flag.Uint("udp-size", 0, "EDNS0 UDP buffer size to advertise, 0 sends queries without EDNS0")
+	source   = flag.String("source", "", "comma-separated list of local addresses to send queries from, at most one IPv4 and one IPv6")
+	iface    = flag.String("interface", "", "local interface to send queries from, ignored if -source is set")
+	ttlMin   = flag.Duration("ns-ttl-min", nsTTLPolicy.Min, "lowest allowed TTL of the authoritative NS records")
+	ttlMax   = flag.Duration("ns-ttl-max", nsTTLPolicy.Max, "highest allowed TTL of the authoritative NS records, 0 for no limit")
+	ttlRatio = flag.Float64("ns-ttl-ratio", nsTTLPolicy.Ratio, "largest allowed ratio between the parent and authoritative NS TTLs, 0 to not compare them")
+	minNS    = flag.Uint("min-ns", nsDiversity.Hosts, "least number of distinct nameserver hosts and addresses every zone should have")
+	minNets  = flag.Uint("min-networks", nsDiversity.Prefixes, "least number of distinct IPv4 /24 and IPv6 /48 networks the nameservers of every zone should be in")
+	minASNs  = flag.Uint("min-asns", nsDiversity.ASNs, "least number of distinct ASNs the nameservers of every zone should be in, only checked with -asn-file")
+	asnFile  = flag.String("asn-file", "", "prefix to ASN file, with lines of \"prefix/length ASN\" or \"address length ASN\", used to check the ASN diversity of nameservers")
+	fpFile   = flag.String("fingerprints", "", "file of hosted DNS provider fingerprints, lame delegations to a provider matching one are reported as potentially claimable")
+	denyNets = flag.String("deny-cidrs", "", "comma-separated list of CIDRs nameserver addresses must not be in, on top of the IANA special-purpose ranges")
+	allowNet = flag.String("allow-cidrs", "", "comma-separated list of CIDRs nameserver addresses may be in even if they are special-purpose, for private roots")
+	pslFile  = flag.String("psl", "", "public_suffix_list.dat file used to find the registrable domain of nameservers, defaults to the built in list")
+	qpsOver  = flag.String("qps-override", "", "comma-separated list of name=qps caps shared by the delegated nameservers of the zone name, the nameserver host name, or all nameservers under a *.name wildcard, ex: com=50,ns1.example.net=5,*.example.net=20")
 )
 
 var work *jobs.Jobs
@@ -57,6 +97,144 @@ func main() {
 		}
 	}
 
+	// parse expected DoT
+	for _, ns := range strings.Split(*dotSet, ",") {
+		if ns != "" {
+			expectedDoT = append(expectedDoT, cleanDomain(ns))
+		}
+	}
+
+	// limit address families
+	if *only4 && *only6 {
+		fmt.Fprintln(os.Stderr, "-4 and -6 can not be used together")
+		flag.Usage()
+		return
+	}
+	queryIPv4, queryIPv6 = !*only6, !*only4
+
+	// replace the root servers
+	if *hintFile != "" && *roots != "" {
+		fmt.Fprintln(os.Stderr, "-root-hints and -root-servers can not be used together")
+		flag.Usage()
+		return
+	}
+	if *hintFile != "" {
+		hints, err := loadRootHints(*hintFile)
+		check(err)
+		setRootHints(hints)
+	}
+	if *roots != "" {
+		hints, err := parseRootServers(*roots)
+		check(err)
+		setRootHints(hints)
+	}
+
+	// IPv6 addresses would all time out and be counted as lame on a host without IPv6, private roots are left alone
+	if queryIPv4 && queryIPv6 && *hintFile == "" && *roots == "" && !hasIPv6Route() {
+		log.Printf("no IPv6 route, only querying nameservers over IPv4, use -6 to query over IPv6 only")
+		queryIPv6 = false
+	}
+
+	// zone transfers
+	if *axfrSave != "" {
+		if info, err := os.Stat(*axfrSave); err != nil || !info.IsDir() {
+			fmt.Fprintf(os.Stderr, "-axfr-dir %q is not a directory\n", *axfrSave)
+			flag.Usage()
+			return
+		}
+		axfrDir = *axfrSave
+	}
+
+	// recursion probe
+	recursionName = cleanDomain(*recName)
+
+	// NS TTL policy
+	nsTTLPolicy = ttlPolicy{Min: *ttlMin, Max: *ttlMax, Ratio: *ttlRatio}
+	check(nsTTLPolicy.validate())
+
+	// nameserver diversity
+	nsDiversity = diversityPolicy{Hosts: *minNS, Prefixes: *minNets, ASNs: *minASNs}
+	if *asnFile != "" {
+		table, err := loadASNTable(*asnFile)
+		check(err)
+		asns = table
+	}
+
+	// nameserver address ranges
+	denied, err := parseCIDRs(*denyNets, "denied by -deny-cidrs")
+	check(err)
+	allowed, err := parseCIDRs(*allowNet, "allowed by -allow-cidrs")
+	check(err)
+	deniedRanges, allowedRanges = denied, allowed
+
+	// hosted DNS provider fingerprints
+	if *fpFile != "" {
+		fps, err := loadFingerprints(*fpFile)
+		check(err)
+		fingerprints = fps
+	}
+
+	// public suffix list
+	if *pslFile != "" {
+		list, err := loadPSL(*pslFile)
+		check(err)
+		suffixes = list
+	}
+
+	// dns client settings
+	var o clientOverrides
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "dial-timeout":
+			o.DialTimeout = dialTO
+		case "read-timeout":
+			o.ReadTimeout = readTO
+		case "write-timeout":
+			o.WriteTimeout = writeTO
+		case "retries":
+			o.Retries = retries
+		case "backoff":
+			o.Backoff = backoff
+		}
+	})
+	cfg, err := profileConfig(*profile, o)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		return
+	}
+	cfg.Interface = *iface
+	if *udpSize > 65535 {
+		fmt.Fprintln(os.Stderr, "-udp-size must be at most 65535")
+		flag.Usage()
+		return
+	}
+	cfg.UDPSize = uint16(*udpSize)
+	for _, addr := range strings.Split(*source, ",") {
+		if addr != "" {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				fmt.Fprintf(os.Stderr, "invalid source address %q\n", addr)
+				flag.Usage()
+				return
+			}
+			cfg.Source = append(cfg.Source, ip)
+		}
+	}
+	check(setClientConfig(cfg))
+
+	health = newHealthTable(*breakerN, *breakerT)
+
+	// rate limits
+	if *qps < 0 || *qpsAddr < 0 {
+		fmt.Fprintln(os.Stderr, "-qps and -server-qps can not be negative")
+		flag.Usage()
+		return
+	}
+	overrides, err := parseRateOverrides(*qpsOver)
+	check(err)
+	limits = newRateLimiter(*qps, *qpsAddr, overrides)
+
 	// can't run on 0 threads
 	if *parallel < 1 {
 		fmt.Fprintln(os.Stderr, "must enter a positive number of parallel threads")
@@ -86,6 +264,7 @@ func main() {
 	// add lists
 	for _, list := range strings.Split(*useLists, ",") {
 		if list != "" {
+			list := list
 			inputGroup.Go(func() error {
 				names, err := sources.GetList(list)
 				if err != nil {
@@ -98,12 +277,19 @@ func main() {
 	}
 
 	// wait for all adding to be done
-	err := inputGroup.Wait()
+	err = inputGroup.Wait()
 	check(err)
 	// wait for all processing to be done
 	err = work.Wait()
 	check(err)
 
+	reportDanglingNS()
+	reportUnregisteredNS()
+	reportNSCycles()
+	if report := health.String(); report != "" {
+		fmt.Println(report)
+	}
+
 	v("done")
 	v("took: %s", time.Since(start).Round(time.Second))
 }
@@ -144,3 +330,8 @@ func finding(format string, d ...interface{}) {
 	fmt.Printf(format2, d...)
 	v(format2, d...)
 }
+
+// highFinding logs a finding that needs attention first, such as a delegation that can be taken over
+func highFinding(format string, d ...interface{}) {
+	finding("[HIGH] "+format, d...)
+}
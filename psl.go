@@ -0,0 +1,154 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/publicsuffix"
+)
+
+// suffixList returns the public suffix of a domain, ex: co.uk for www.example.co.uk, and whether it is an ICANN suffix
+// rather than one run by a provider, ex: github.io
+type suffixList interface {
+	PublicSuffix(domain string) (string, bool)
+}
+
+// embeddedPSL is the Public Suffix List embedded in golang.org/x/net
+type embeddedPSL struct{}
+
+func (embeddedPSL) PublicSuffix(domain string) (string, bool) {
+	return publicsuffix.PublicSuffix(domain)
+}
+
+// suffixes is the embedded Public Suffix List, unless one is loaded with -psl
+var suffixes suffixList = embeddedPSL{}
+
+// pslRules is a Public Suffix List loaded from a file, https://publicsuffix.org/list/
+type pslRules struct {
+	rules      map[string]bool
+	wildcards  map[string]bool // parent of each *. rule
+	exceptions map[string]bool
+	private    map[string]bool // rules from the PRIVATE DOMAINS section
+}
+
+// loadPSL reads a public_suffix_list.dat style file
+func loadPSL(path string) (*pslRules, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	l := &pslRules{
+		rules:      make(map[string]bool),
+		wildcards:  make(map[string]bool),
+		exceptions: make(map[string]bool),
+		private:    make(map[string]bool),
+	}
+	private := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// rules end at the first whitespace
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if strings.HasPrefix(fields[0], "//") {
+			line := scanner.Text()
+			if strings.Contains(line, "===BEGIN PRIVATE DOMAINS===") {
+				private = true
+			} else if strings.Contains(line, "===END PRIVATE DOMAINS===") {
+				private = false
+			}
+			continue
+		}
+		rule := cleanDomain(fields[0])
+		var name string
+		switch {
+		case strings.HasPrefix(rule, "!"):
+			name = rule[1:]
+			l.exceptions[name] = true
+		case strings.HasPrefix(rule, "*."):
+			name = rule[2:]
+			l.wildcards[name] = true
+		default:
+			name = rule
+			l.rules[name] = true
+		}
+		if private {
+			l.private[name] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(l.rules)+len(l.wildcards) == 0 {
+		return nil, fmt.Errorf("no rules in %s", path)
+	}
+	return l, nil
+}
+
+// PublicSuffix returns the longest matching rule for domain, with exceptions taking priority, and the last label if none match.
+// Like the embedded list, the last label is not counted as an ICANN suffix.
+func (l *pslRules) PublicSuffix(domain string) (string, bool) {
+	labels := dns.SplitDomainName(cleanDomain(domain))
+	for i := range labels {
+		candidate := strings.Join(labels[i:], ".")
+		if l.exceptions[candidate] {
+			return strings.Join(labels[i+1:], "."), !l.private[candidate]
+		}
+		if l.rules[candidate] {
+			return candidate, !l.private[candidate]
+		}
+		if parent := strings.Join(labels[i+1:], "."); i+1 < len(labels) && l.wildcards[parent] {
+			return candidate, !l.private[parent]
+		}
+	}
+	if len(labels) == 0 {
+		return "", false
+	}
+	return labels[len(labels)-1], false
+}
+
+// icannSuffix returns the public suffix of domain run by a registry, walking up past any private suffix such as github.io,
+// whose names are handed out by a provider rather than registered
+func icannSuffix(domain string) string {
+	suffix, icann := suffixes.PublicSuffix(domain)
+	for !icann && strings.Contains(suffix, ".") {
+		suffix, icann = suffixes.PublicSuffix(suffix[strings.Index(suffix, ".")+1:])
+	}
+	return suffix
+}
+
+// registrableDomain returns the ICANN public suffix of domain plus one label, or "" if domain is a public suffix itself
+// or an IP address
+func registrableDomain(domain string) string {
+	domain = cleanDomain(domain)
+	if net.ParseIP(domain) != nil {
+		return ""
+	}
+	suffix := icannSuffix(domain)
+	if suffix == domain || !dns.IsSubDomain(suffix, domain) {
+		return ""
+	}
+	labels := dns.SplitDomainName(domain)
+	return strings.Join(labels[len(labels)-dns.CountLabel(suffix)-1:], ".")
+}
@@ -0,0 +1,79 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegistrableDomain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "public_suffix_list.dat")
+	list := `// comment
+com
+uk
+co.uk
+*.ck
+!www.ck
+io
+// ===BEGIN PRIVATE DOMAINS===
+github.io
+*.cloud.example.uk
+// ===END PRIVATE DOMAINS===
+`
+	if err := os.WriteFile(path, []byte(list), 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := loadPSL(path)
+	if err != nil {
+		t.Fatalf("loadPSL() error: %s", err)
+	}
+	saved := suffixes
+	suffixes = l
+	t.Cleanup(func() { suffixes = saved })
+
+	for host, want := range map[string]string{
+		"ns1.example.com.":        "example.com",
+		"ns1.example.co.uk":       "example.co.uk",
+		"ns1.example.uk":          "example.uk",
+		"co.uk":                   "",
+		"ns1.example.test.ck":     "example.test.ck",
+		"test.ck":                 "",
+		"ns.www.ck":               "www.ck",
+		"ns1.example.test":        "example.test",
+		"192.0.2.1":               "",
+		"ns.user.github.io":       "github.io",
+		"github.io":               "github.io",
+		"ns.a.b.cloud.example.uk": "example.uk",
+	} {
+		if got := registrableDomain(host); got != want {
+			t.Errorf("registrableDomain(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
+
+func TestRegistrableDomainEmbedded(t *testing.T) {
+	// github.io is in the private section of the list, the registry only knows github.io under io
+	for host, want := range map[string]string{
+		"ns1.example.com":   "example.com",
+		"ns.user.github.io": "github.io",
+		"ns1.example.co.uk": "example.co.uk",
+	} {
+		if got := registrableDomain(host); got != want {
+			t.Errorf("registrableDomain(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
@@ -16,6 +16,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"sort"
@@ -26,40 +27,115 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-// https://www.iana.org/domains/root/servers
-var rootServers = []string{
-	"a.root-servers.net",
-	"b.root-servers.net",
-	"c.root-servers.net",
-	"d.root-servers.net",
-	"e.root-servers.net",
-	"f.root-servers.net",
-	"g.root-servers.net",
-	"h.root-servers.net",
-	"i.root-servers.net",
-	"j.root-servers.net",
-	"k.root-servers.net",
-	"l.root-servers.net",
-	"m.root-servers.net",
+// address families to query nameservers over, limited by the -4 and -6 flags
+var (
+	queryIPv4 = true
+	queryIPv6 = true
+)
+
+// ipv6Probe is a global IPv6 address, a.root-servers.net, used to check that the host can send queries over IPv6
+const ipv6Probe = "[2001:503:ba3e::2:30]:53"
+
+// hasIPv6Route returns false when the host has no route to the IPv6 internet, so that every IPv6 query would time out.
+// Connecting a UDP socket only looks up the route, nothing is sent.
+func hasIPv6Route() bool {
+	c, err := net.Dial("udp6", ipv6Probe)
+	if err != nil {
+		return false
+	}
+	c.Close()
+	return true
 }
 
+// ports nameservers are queried on
+var (
+	dnsPort = "53"
+	dotPort = "853"
+)
+
+// transports a query can be sent over
 const (
-	dnsTimeout = time.Second * 10
-	dnsRetry   = 3
+	transportUDP = "udp" // retried over TCP when the response is truncated
+	transportTCP = "tcp"
+	transportTLS = "tls" // DNS over TLS, RFC 7858
 )
 
-var dnsClient = dns.Client{
-	Timeout: dnsTimeout,
-}
+// sections of a response the NS records were found in
+const (
+	sectionAnswer    = "answer"
+	sectionAuthority = "authority"
+)
 
 type queryResult struct {
-	Err           error
-	Authoritative bool
-	NS            []string
+	Err                error
+	Rcode              int
+	Authoritative      bool
+	Truncated          bool
+	RecursionAvailable bool
+	NS                 []string
+	NSOwner            string // owner name of the NS records, differs from the query name on referrals
+	NSSection          string // section the NS records were found in, empty if there were none
+	NSTTL              uint32 // lowest TTL of the NS records
+	Size               int    // size of the response in bytes
+	ChildOnly          bool   // the server is only listed by the authoritative servers, not the parent, only set on per host results
+	// SOA of the zone from the same address, only set on per address results by checkSOA
+	SOA *dns.SOA
+	// response to a recursive query for another name, only set on per address results by checkRecursion
+	Recursion *recursionProbe
+	// result of a zone transfer from the same address, only set on per address results by checkAXFR
+	AXFR *axfrResult
+	// DNSKEY set of the zone from the same address, only set on per address results by checkDNSSEC
+	DNSKEY []*dns.DNSKEY
+	// addresses of the NS hosts in the additional section, only set on per address results
+	Glue map[string][]net.IP
+	// results for each address of the server keyed by IP, only set on per host results
+	Addrs map[string]*queryResult
+	// results of the same query over other transports keyed by transport, only set on per address results
+	Transports map[string]*queryResult
 }
 
 func (r *queryResult) String() string {
-	return fmt.Sprintf("Err: %v, AA: %t, NS: %+v", r.Err, r.Authoritative, r.NS)
+	out := fmt.Sprintf("Err: %v, AA: %t, NS: %+v", r.Err, r.Authoritative, r.NS)
+	if r.ChildOnly {
+		out += ", child-only"
+	}
+	if r.Addrs == nil && r.Err == nil {
+		out += fmt.Sprintf(", Rcode: %s, TC: %t, RA: %t, NSOwner: %q, NSSection: %q, NSTTL: %d, Size: %d",
+			dns.RcodeToString[r.Rcode], r.Truncated, r.RecursionAvailable, r.NSOwner, r.NSSection, r.NSTTL, r.Size)
+	}
+	if r.SOA != nil {
+		out += fmt.Sprintf(", SOA serial: %d", r.SOA.Serial)
+	}
+	if r.AXFR != nil {
+		out += fmt.Sprintf(", AXFR: %s, records: %d", r.AXFR.Status, r.AXFR.Records)
+	}
+	if r.Recursion != nil {
+		out += fmt.Sprintf(", recursion: RA: %t, answered: %t", r.Recursion.RecursionAvailable, r.Recursion.Answered)
+	}
+	for _, addr := range r.sortedAddrs() {
+		out += fmt.Sprintf("\n\t\t\t[%s]: %s", addr, r.Addrs[addr].String())
+	}
+	for transport, t := range r.Transports {
+		out += fmt.Sprintf("\n\t\t\t\t%s: %s", transport, t.String())
+	}
+	return out
+}
+
+// setTransport records the result of the same query over another transport
+func (r *queryResult) setTransport(transport string, result *queryResult) {
+	if r.Transports == nil {
+		r.Transports = make(map[string]*queryResult)
+	}
+	r.Transports[transport] = result
+}
+
+func (r *queryResult) sortedAddrs() []string {
+	out := make([]string, 0, len(r.Addrs))
+	for addr := range r.Addrs {
+		out = append(out, addr)
+	}
+	sort.Strings(out)
+	return out
 }
 
 type queryGroup struct {
@@ -102,6 +178,47 @@ func (g *queryGroup) allNS() []string {
 	return out
 }
 
+// serverAddr formats a nameserver and one of its addresses for findings, ex: ns1.example.net [192.0.2.7]
+func serverAddr(server, addr string) string {
+	return fmt.Sprintf("%s [%s]", server, addr)
+}
+
+// addrOutput is the output of a function run against a single nameserver address
+type addrOutput[T any] struct {
+	Server string
+	Addr   string
+	Out    T
+}
+
+// forEachAnsweringAddr runs fn in parallel for every address in the group that answered the NS query,
+// and returns the outputs sorted by server and address
+func forEachAnsweringAddr[T any](g *queryGroup, fn func(server string, ip net.IP) T) []addrOutput[T] {
+	out := make([]addrOutput[T], 0, len(g.Results))
+	servers := make([]string, 0, len(g.Results))
+	for server := range g.Results {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	for _, server := range servers {
+		for _, addr := range g.Results[server].sortedAddrs() {
+			if g.Results[server].Addrs[addr].Err == nil {
+				out = append(out, addrOutput[T]{Server: server, Addr: addr})
+			}
+		}
+	}
+
+	var eg errgroup.Group
+	for i := range out {
+		i := i
+		eg.Go(func() error {
+			out[i].Out = fn(out[i].Server, net.ParseIP(out[i].Addr))
+			return nil
+		})
+	}
+	eg.Wait()
+	return out
+}
+
 func queryNSParallel(domain string, servers []string) (*queryGroup, error) {
 	domain = dns.Fqdn(domain)
 	g, _ := errgroup.WithContext(context.Background())
@@ -110,14 +227,9 @@ func queryNSParallel(domain string, servers []string) (*queryGroup, error) {
 	for i, server := range servers {
 		i, server := i, server // https://golang.org/doc/faq#closures_and_goroutines
 		g.Go(func() error {
-			ns, auth, err := queryNSServer(server, domain)
-			results[i] = &queryResult{
-				Err:           err,
-				NS:            ns,
-				Authoritative: auth,
-			}
-			if err != nil {
-				v("error on queryNSServer(%q, %q): %v", server, domain, err)
+			results[i] = queryNSHost(server, domain)
+			if results[i].Err != nil {
+				v("error on queryNSHost(%q, %q): %v", server, domain, results[i].Err)
 				// don't return the error so that all queries capture their responses
 			}
 			return nil
@@ -143,42 +255,173 @@ func queryNSParallel(domain string, servers []string) (*queryGroup, error) {
 	return result, nil
 }
 
-func queryNSServer(server, domain string) ([]string, bool, error) {
+// queryNSHost resolves all addresses of server and queries each of them
+func queryNSHost(server, domain string) *queryResult {
+	ips, err := resolveNS(server)
+	if err != nil {
+		return &queryResult{Err: err}
+	}
+
+	var g errgroup.Group
+	results := make([]*queryResult, len(ips))
+	for i, ip := range ips {
+		i, ip := i, ip
+		g.Go(func() error {
+			results[i] = queryNSServer(server, ip, domain, transportUDP)
+			return nil
+		})
+	}
+	g.Wait()
+
+	out := &queryResult{
+		Addrs: make(map[string]*queryResult, len(ips)),
+	}
+	ns := make(map[string]bool)
+	answered := false
+	for i, ip := range ips {
+		r := results[i]
+		out.Addrs[ip.String()] = r
+		if r.Err != nil {
+			if out.Err == nil {
+				out.Err = r.Err
+			}
+			continue
+		}
+		answered = true
+		out.Authoritative = out.Authoritative || r.Authoritative
+		for _, n := range r.NS {
+			ns[n] = true
+		}
+	}
+	// the host is only in error if none of its addresses answered
+	if answered {
+		out.Err = nil
+	}
+	out.NS = stringMapToArrayKeys(ns)
+	sort.Strings(out.NS)
+	return out
+}
+
+func queryNSServer(server string, ip net.IP, domain, transport string) *queryResult {
+	return queryNSServerWith(server, ip, domain, transport, exchangeRetry)
+}
+
+// queryNSServerWith sends the NS query for domain to the server address with send
+func queryNSServerWith(server string, ip net.IP, domain, transport string, send sendFunc) *queryResult {
 	domain = dns.Fqdn(domain)
-	//server = strings.TrimSuffix(server, ".")
 	//v("dns query: @%s NS %s", server, domain)
 	m := new(dns.Msg)
 	m.SetQuestion(domain, dns.TypeNS)
 	m.RecursionDesired = false
 
+	in, err := send(m, server, ip, transport)
+	if err != nil {
+		return &queryResult{Err: err}
+	}
+
+	v("dns query (@%s NS %s) Authoritative: %t Answer:%d NS:%d", serverAddr(server, ip.String()), domain, in.Authoritative, len(in.Answer), len(in.Ns))
+
+	out := &queryResult{
+		Rcode:              in.Rcode,
+		Authoritative:      in.Authoritative,
+		Truncated:          in.Truncated,
+		RecursionAvailable: in.RecursionAvailable,
+		Size:               in.Len(),
+		NS:                 make([]string, 0, 2),
+	}
+	for _, section := range []struct {
+		name string
+		rrs  []dns.RR
+	}{{sectionAnswer, in.Answer}, {sectionAuthority, in.Ns}} {
+		for _, r := range section.rrs {
+			if t, ok := r.(*dns.NS); ok {
+				//v("dns answer NS @%s\t%s:\t%s\n", server, domain, t.Ns)
+				out.NS = append(out.NS, cleanDomain(t.Ns))
+				if len(out.NS) == 1 || t.Hdr.Ttl < out.NSTTL {
+					out.NSTTL = t.Hdr.Ttl
+				}
+				out.NSOwner = cleanDomain(t.Hdr.Name)
+				out.NSSection = section.name
+			}
+		}
+		if len(out.NS) > 0 {
+			// only use the authority section when the answer had no NS records
+			break
+		}
+	}
+	out.Glue = glueAddrs(in, out.NS)
+	addGlue(in, out.NS)
+
+	sort.Strings(out.NS)
+	return out
+}
+
+// exchangeRetry sends the query with exchange, retrying failures with the configured backoff
+func exchangeRetry(m *dns.Msg, server string, ip net.IP, transport string) (*dns.Msg, error) {
+	return retry(m, server, ip, transport, exchange)
+}
+
+// sendFunc sends a query to a nameserver address over transport, like exchange
+type sendFunc func(m *dns.Msg, server string, ip net.IP, transport string) (*dns.Msg, error)
+
+// retry sends the query with send, retrying failures with the configured backoff
+func retry(m *dns.Msg, server string, ip net.IP, transport string, send sendFunc) (*dns.Msg, error) {
 	var in *dns.Msg
 	var err error
-	for i := 0; i < dnsRetry; i++ {
-		in, _, err = dnsClient.Exchange(m, net.JoinHostPort(server, "53"))
-		if err == nil {
+	backoff := clientCfg.Backoff
+	for i := uint(0); i <= clientCfg.Retries; i++ {
+		in, err = send(m, server, ip, transport)
+		if err == nil || errors.Is(err, errCircuitOpen) {
 			break
 		} else {
-			v("queryNSServer(%q, @%q) try %d, error: %s", domain, server, i+1, err)
+			v("exchange(%s %q, @%s, %s) try %d, error: %s", dns.TypeToString[m.Question[0].Qtype], m.Question[0].Name, serverAddr(server, ip.String()), transport, i+1, err)
+		}
+		if i < clientCfg.Retries {
+			time.Sleep(backoff)
+			backoff *= 2
 		}
-		time.Sleep(time.Second)
-	}
-	if err != nil {
-		return nil, false, err
 	}
+	return in, err
+}
 
-	v("dns query (@%s NS %s) Authoritative: %t Answer:%d NS:%d", server, domain, in.Authoritative, len(in.Answer), len(in.Ns))
+// exchange sends a single query to a nameserver address over transport with the configured EDNS0 settings,
+// retrying over TCP if a UDP response was truncated
+func exchange(m *dns.Msg, server string, ip net.IP, transport string) (*dns.Msg, error) {
+	if clientCfg.UDPSize > 0 && m.IsEdns0() == nil {
+		m = m.Copy()
+		m.SetEdns0(clientCfg.UDPSize, false)
+	}
+	in, err := sendQuery(m, server, ip, transport)
+	if transport == transportUDP && err == nil && in.Truncated {
+		v("truncated response from %s for %s, retrying over TCP", serverAddr(server, ip.String()), m.Question[0].Name)
+		in, err = sendQuery(m, server, ip, transportTCP)
+	}
+	return in, err
+}
 
-	out := make([]string, 0, 2)
-	for _, r := range append(in.Answer, in.Ns...) {
-		if t, ok := r.(*dns.NS); ok {
-			//v("dns answer NS @%s\t%s:\t%s\n", server, domain, t.Ns)
-			t.Ns = cleanDomain(t.Ns)
-			out = append(out, t.Ns)
-		}
+// sendQuery sends m as is to a nameserver address over transport, unless the address has been failing
+func sendQuery(m *dns.Msg, server string, ip net.IP, transport string) (*dns.Msg, error) {
+	c := client(transport, ip)
+	if transport == transportTLS {
+		c = withServerName(c, server)
 	}
+	return sendQueryWith(c, m, server, ip, transport)
+}
 
-	sort.Strings(out)
-	return out, in.Authoritative, nil
+// sendQueryWith sends m as is to a nameserver address over transport with the client c, unless the address has been failing
+func sendQueryWith(c *dns.Client, m *dns.Msg, server string, ip net.IP, transport string) (*dns.Msg, error) {
+	if err := health.Allow(server, ip.String(), transport); err != nil {
+		return nil, err
+	}
+	limits.Wait(server, ip)
+	port := dnsPort
+	if transport == transportTLS {
+		port = dotPort
+	}
+	in, _, err := c.Exchange(m, net.JoinHostPort(ip.String(), port))
+	health.Record(server, ip.String(), transport, err)
+	limits.Record(server, ip, in, err)
+	return in, err
 }
 
 func cleanDomain(s string) string {
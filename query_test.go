@@ -0,0 +1,358 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"lame-dns/cache"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// startTestServer runs a DNS server on addr:dnsPort over UDP and TCP until the test ends
+func startTestServer(t *testing.T, addr string, handler dns.HandlerFunc) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", net.JoinHostPort(addr, dnsPort))
+	if err != nil {
+		t.Fatalf("ListenPacket(%q): %s", addr, err)
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(addr, dnsPort))
+	if err != nil {
+		t.Fatalf("Listen(%q): %s", addr, err)
+	}
+	for _, server := range []*dns.Server{{PacketConn: pc, Handler: handler}, {Listener: l, Handler: handler}} {
+		server := server
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+		go server.ActivateAndServe()
+		<-started
+		t.Cleanup(func() { server.Shutdown() })
+	}
+}
+
+// startTestTLSServer runs a DNS over TLS server with a self-signed certificate on addr:dotPort until the test ends
+func startTestTLSServer(t *testing.T, addr string, handler dns.HandlerFunc) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey(): %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ns1.example.test"},
+		DNSNames:     []string{"ns1.example.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate(): %s", err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+
+	l, err := tls.Listen("tcp", net.JoinHostPort(addr, dotPort), &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatalf("tls.Listen(%q): %s", addr, err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{Listener: l, Net: "tcp-tls", Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+}
+
+// setupTestEnv points queries at the test ports with an empty address cache and no retries, restoring them when the test ends
+func setupTestEnv(t *testing.T) {
+	t.Helper()
+	port, tlsPort, addrs, cfg := dnsPort, dotPort, nsAddrs, clientCfg
+	dnsPort, dotPort = "10053", "10853"
+	nsAddrs = newAddrCache()
+	if err := setClientConfig(clientConfig{DialTimeout: time.Second, ReadTimeout: time.Second, WriteTimeout: time.Second}); err != nil {
+		t.Fatalf("setClientConfig(): %s", err)
+	}
+	t.Cleanup(func() {
+		dnsPort, dotPort, nsAddrs = port, tlsPort, addrs
+		setClientConfig(cfg)
+	})
+}
+
+func TestQueryNSHost(t *testing.T) {
+	setupTestEnv(t)
+	nsAddrs.Add("ns1.example.test", net.ParseIP("127.0.0.2"), net.ParseIP("127.0.0.3"))
+	nsAddrs.Set("ns1.example.test", dns.TypeAAAA, nil, nil)
+
+	for _, addr := range []string{"127.0.0.2", "127.0.0.3"} {
+		auth := addr == "127.0.0.2"
+		startTestServer(t, addr, func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			m.Authoritative = auth
+			ns := &dns.NS{
+				Hdr: dns.RR_Header{Name: "example.test.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 3600},
+				Ns:  "ns2.example.test.",
+			}
+			if auth {
+				m.Answer = append(m.Answer, ns)
+			} else {
+				// a referral, the only kind of response glue is taken from
+				m.Ns = append(m.Ns, ns)
+			}
+			m.Extra = append(m.Extra, &dns.A{
+				Hdr: dns.RR_Header{Name: "ns2.example.test.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+				A:   net.ParseIP("127.0.0.4"),
+			})
+			w.WriteMsg(m)
+		})
+	}
+
+	r := queryNSHost("ns1.example.test", "example.test")
+	if r.Err != nil {
+		t.Fatalf("queryNSHost() error: %s", r.Err)
+	}
+	if len(r.Addrs) != 2 {
+		t.Fatalf("queryNSHost() got %d address results, want 2", len(r.Addrs))
+	}
+	if !r.Addrs["127.0.0.2"].Authoritative || r.Addrs["127.0.0.3"].Authoritative {
+		t.Errorf("queryNSHost() per address authoritative mismatch: %s", r.String())
+	}
+	if !StringArrayEquals(r.NS, []string{"ns2.example.test"}) {
+		t.Errorf("queryNSHost() NS = %v, want [ns2.example.test]", r.NS)
+	}
+	if ips, _, _ := nsAddrs.Get("ns2.example.test", dns.TypeA); len(ips) != 1 || !ips[0].Equal(net.ParseIP("127.0.0.4")) {
+		t.Errorf("glue for ns2.example.test = %v, want [127.0.0.4]", ips)
+	}
+}
+
+func TestGlueAddrs(t *testing.T) {
+	msg := func(authoritative bool, rrs ...string) *dns.Msg {
+		m := new(dns.Msg)
+		m.Authoritative = authoritative
+		for _, s := range rrs {
+			rr, err := dns.NewRR(s)
+			if err != nil {
+				t.Fatalf("NewRR(%q) error: %s", s, err)
+			}
+			if rr.Header().Rrtype == dns.TypeNS {
+				m.Ns = append(m.Ns, rr)
+			} else {
+				m.Extra = append(m.Extra, rr)
+			}
+		}
+		return m
+	}
+	nameservers := []string{"ns1.example.test", "ns1.victim.test"}
+
+	// a referral for example.test may only carry glue for nameservers inside example.test
+	referral := msg(false,
+		"example.test. 3600 IN NS ns1.example.test.",
+		"example.test. 3600 IN NS ns1.victim.test.",
+		"ns1.example.test. 3600 IN A 192.0.2.1",
+		"ns1.victim.test. 3600 IN A 203.0.113.66",
+	)
+	if glue := glueAddrs(referral, nameservers); len(glue) != 1 || len(glue["ns1.example.test"]) != 1 {
+		t.Errorf("glueAddrs(referral) = %v, want only ns1.example.test", glue)
+	}
+
+	// an authoritative answer is not a referral, so it has no glue at all
+	answer := msg(true,
+		"example.test. 3600 IN NS ns1.example.test.",
+		"ns1.example.test. 3600 IN A 192.0.2.1",
+	)
+	if glue := glueAddrs(answer, nameservers); len(glue) != 0 {
+		t.Errorf("glueAddrs(answer) = %v, want none", glue)
+	}
+}
+
+func TestExchangeTruncated(t *testing.T) {
+	setupTestEnv(t)
+	startTestServer(t, "127.0.0.2", func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		if w.RemoteAddr().Network() == "udp" {
+			m.Truncated = true
+		} else {
+			m.Authoritative = true
+		}
+		w.WriteMsg(m)
+	})
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.test.", dns.TypeNS)
+	in, err := exchange(m, "ns1.example.test", net.ParseIP("127.0.0.2"), transportUDP)
+	if err != nil {
+		t.Fatalf("exchange() error: %s", err)
+	}
+	if in.Truncated || !in.Authoritative {
+		t.Errorf("exchange() did not retry truncated response over TCP: %s", in.String())
+	}
+}
+
+// zoneHandler returns a handler that answers authoritatively from the zones provided in zone file format,
+// giving referrals with glue for any delegations inside them
+func zoneHandler(t *testing.T, zones ...string) dns.HandlerFunc {
+	t.Helper()
+	var records []dns.RR
+	origins := make(map[string]bool)
+	for _, zone := range zones {
+		zp := dns.NewZoneParser(strings.NewReader(zone), "", "")
+		for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+			if rr.Header().Rrtype == dns.TypeSOA {
+				origins[rr.Header().Name] = true
+			}
+			records = append(records, rr)
+		}
+		if err := zp.Err(); err != nil {
+			t.Fatalf("zone parse error: %s", err)
+		}
+	}
+
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+
+		// find the closest zone to the query name
+		origin := ""
+		for o := range origins {
+			if dns.IsSubDomain(o, q.Name) && (origin == "" || dns.CountLabel(o) > dns.CountLabel(origin)) {
+				origin = o
+			}
+		}
+		if origin == "" {
+			m.Rcode = dns.RcodeRefused
+			w.WriteMsg(m)
+			return
+		}
+
+		// check for a delegation between the zone and the query name
+		for _, rr := range records {
+			if ns, ok := rr.(*dns.NS); ok && ns.Hdr.Name != origin && dns.IsSubDomain(origin, ns.Hdr.Name) && dns.IsSubDomain(ns.Hdr.Name, q.Name) {
+				if ns.Hdr.Name == q.Name && q.Qtype == dns.TypeDS {
+					continue
+				}
+				for _, rr := range records {
+					if t, ok := rr.(*dns.NS); ok && t.Hdr.Name == ns.Hdr.Name {
+						m.Ns = append(m.Ns, rr)
+						for _, glue := range records {
+							if glue.Header().Name == t.Ns && (glue.Header().Rrtype == dns.TypeA || glue.Header().Rrtype == dns.TypeAAAA) {
+								m.Extra = append(m.Extra, glue)
+							}
+						}
+					}
+				}
+				w.WriteMsg(m)
+				return
+			}
+		}
+
+		m.Authoritative = true
+		exists := false
+		for _, rr := range records {
+			if rr.Header().Name == q.Name {
+				exists = true
+				if rr.Header().Rrtype == q.Qtype || (rr.Header().Rrtype == dns.TypeCNAME && q.Qtype != dns.TypeCNAME) {
+					m.Answer = append(m.Answer, rr)
+				}
+			}
+		}
+		if !exists {
+			m.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(m)
+	}
+}
+
+// testRootZone delegates test. to ns.test at 127.0.0.3
+const testRootZone = `
+. 3600 IN SOA root.test. hostmaster.root.test. 1 3600 600 86400 300
+. 3600 IN NS root.test.
+test. 3600 IN NS ns.test.
+ns.test. 3600 IN A 127.0.0.3
+`
+
+// setupTestRoot starts the walk from a private root at 127.0.0.2 serving testRootZone, over IPv4 only with an empty cache
+func setupTestRoot(t *testing.T) {
+	t.Helper()
+	setupTestEnv(t)
+	savedRoots, savedSeen, savedDiversity, savedAllowed := rootServers, seen, nsDiversity, allowedRanges
+	t.Cleanup(func() {
+		rootServers, seen, nsDiversity, allowedRanges = savedRoots, savedSeen, savedDiversity, savedAllowed
+		queryIPv6 = true
+	})
+
+	hints, err := parseRootServers("root.test=127.0.0.2")
+	if err != nil {
+		t.Fatalf("parseRootServers() error: %s", err)
+	}
+	setRootHints(hints)
+	seen = cache.New[[]string]()
+	queryIPv6 = false
+	// every test server is on a single host, on loopback addresses
+	nsDiversity = diversityPolicy{}
+	allowedRanges = mustParseRanges(map[string]string{"127.0.0.0/8": "test servers"})
+	startTestServer(t, "127.0.0.2", zoneHandler(t, testRootZone))
+}
+
+func TestProcessNamePrivateRoot(t *testing.T) {
+	setupTestRoot(t)
+	startTestServer(t, "127.0.0.3", zoneHandler(t, `
+test. 3600 IN SOA ns.test. hostmaster.test. 1 3600 600 86400 300
+test. 3600 IN NS ns.test.
+ns.test. 3600 IN A 127.0.0.3
+example.test. 3600 IN NS ns1.example.test.
+ns1.example.test. 3600 IN A 127.0.0.4
+`))
+	startTestServer(t, "127.0.0.4", zoneHandler(t, `
+example.test. 3600 IN SOA ns1.example.test. hostmaster.example.test. 1 3600 600 86400 300
+example.test. 3600 IN NS ns1.example.test.
+ns1.example.test. 3600 IN A 127.0.0.4
+www.example.test. 3600 IN A 127.0.0.5
+`))
+
+	w := &nameWork{Name: "www.example.test"}
+	if err := processName(context.Background(), w); err != nil {
+		t.Fatalf("processName() error: %s", err)
+	}
+	if w.Lame || w.Problems != 0 {
+		t.Errorf("processName(%q) Lame: %t, Problems: %d, want no problems", w.Name, w.Lame, w.Problems)
+	}
+	if servers, _ := seen.Get("example.test"); !StringArrayEquals(servers, []string{"ns1.example.test"}) {
+		t.Errorf("nameservers for example.test = %v, want [ns1.example.test]", servers)
+	}
+}
+
+// testAuthGroup returns the authoritative answers of ns1.example.test for domain from each of addrs, as checkLame leaves them
+func testAuthGroup(domain string, addrs ...string) *queryGroup {
+	r := &queryResult{Addrs: make(map[string]*queryResult)}
+	for _, addr := range addrs {
+		r.Addrs[addr] = &queryResult{Authoritative: true, NS: []string{"ns1.example.test"}, NSOwner: domain, NSSection: sectionAnswer}
+	}
+	return &queryGroup{
+		Domain:  domain,
+		NS:      []string{"ns1.example.test"},
+		Results: map[string]*queryResult{"ns1.example.test": r},
+	}
+}
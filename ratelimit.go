@@ -0,0 +1,234 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// number of responses from an address to look at before adjusting its rate
+	rateWindow = 20
+	// share of timeouts or REFUSED responses in a window that halves the rate for an address
+	rateSlowRatio = 0.3
+	// slowest rate an address can be adjusted down to
+	rateMin = 0.5
+)
+
+// limiter is a token bucket allowing rate queries per second, in bursts of up to one second worth of queries
+type limiter struct {
+	m      sync.Mutex
+	rate   float64 // 0 is unlimited
+	tokens float64
+	last   time.Time
+}
+
+func newLimiter(rate float64) *limiter {
+	return &limiter{rate: rate, tokens: math.Max(1, rate), last: time.Now()}
+}
+
+// Wait blocks until a query may be sent
+func (l *limiter) Wait() {
+	l.m.Lock()
+	if l.rate <= 0 {
+		l.m.Unlock()
+		return
+	}
+	now := time.Now()
+	l.tokens = math.Min(math.Max(1, l.rate), l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	// take a token now, waiting for it to be refilled if there was none
+	l.tokens--
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.m.Unlock()
+	time.Sleep(wait)
+}
+
+func (l *limiter) Rate() float64 {
+	l.m.Lock()
+	defer l.m.Unlock()
+	return l.rate
+}
+
+func (l *limiter) SetRate(rate float64) {
+	l.m.Lock()
+	defer l.m.Unlock()
+	l.rate = rate
+}
+
+// rateLimiter caps the queries sent in total, to each nameserver address, and to overridden servers or zones.
+// The rate for an address is lowered when it starts timing out or answering REFUSED, and raised back once it recovers.
+type rateLimiter struct {
+	global    *limiter
+	serverQPS float64
+	overrides map[string]*limiter
+
+	m       sync.Mutex
+	servers map[string]*serverLimit
+	hosts   map[string][]*limiter // override limiters of every nameserver host, filled in as delegations are seen
+}
+
+type serverLimit struct {
+	*limiter
+	cm        sync.Mutex
+	responses uint
+	bad       uint
+}
+
+var limits = newRateLimiter(0, 0, nil)
+
+// newRateLimiter creates a rateLimiter, a rate of 0 is unlimited.
+// overrides are shared by every query to the nameserver host named, to a nameserver under a *. wildcard name,
+// or to a delegated nameserver of the zone named, ex: com caps the com registry servers, not every server under com
+func newRateLimiter(qps, serverQPS float64, overrides map[string]float64) *rateLimiter {
+	var r rateLimiter
+	r.global = newLimiter(qps)
+	r.serverQPS = serverQPS
+	r.overrides = make(map[string]*limiter)
+	for name, rate := range overrides {
+		r.overrides[name] = newLimiter(rate)
+	}
+	r.servers = make(map[string]*serverLimit)
+	r.hosts = make(map[string][]*limiter)
+	return &r
+}
+
+// parseRateOverrides parses a comma-separated list of name=qps overrides
+func parseRateOverrides(list string) (map[string]float64, error) {
+	out := make(map[string]float64)
+	for _, entry := range strings.Split(list, ",") {
+		if entry == "" {
+			continue
+		}
+		name, rate, ok := strings.Cut(entry, "=")
+		qps, err := strconv.ParseFloat(rate, 64)
+		if !ok || err != nil || qps < 0 {
+			return nil, fmt.Errorf("invalid rate override %q, expected name=qps", entry)
+		}
+		out[cleanDomain(name)] = qps
+	}
+	return out, nil
+}
+
+func (r *rateLimiter) server(addr string) *serverLimit {
+	r.m.Lock()
+	defer r.m.Unlock()
+	s, ok := r.servers[addr]
+	if !ok {
+		s = &serverLimit{limiter: newLimiter(r.serverQPS)}
+		r.servers[addr] = s
+	}
+	return s
+}
+
+// AddZone records the delegated nameservers of zone, so that an override for the zone applies to queries sent to them
+func (r *rateLimiter) AddZone(zone string, hosts []string) {
+	l, ok := r.overrides[cleanDomain(zone)]
+	if !ok {
+		return
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	for _, host := range hosts {
+		host = cleanDomain(host)
+		matched := r.hostOverrides(host)
+		found := false
+		for _, m := range matched {
+			found = found || m == l
+		}
+		if !found {
+			r.hosts[host] = append(matched, l)
+		}
+	}
+}
+
+// hostOverrides returns the override limiters of host, matching the host and wildcard overrides the first time it is seen.
+// r.m must be held.
+func (r *rateLimiter) hostOverrides(host string) []*limiter {
+	if matched, ok := r.hosts[host]; ok {
+		return matched
+	}
+	var matched []*limiter
+	for name, l := range r.overrides {
+		if strings.HasPrefix(name, "*.") {
+			if suffix := strings.TrimPrefix(name, "*."); host != suffix && dns.IsSubDomain(suffix, host) {
+				matched = append(matched, l)
+			}
+		} else if name == host {
+			matched = append(matched, l)
+		}
+	}
+	r.hosts[host] = matched
+	return matched
+}
+
+// Wait blocks until a query may be sent to the server address
+func (r *rateLimiter) Wait(server string, ip net.IP) {
+	r.global.Wait()
+	r.m.Lock()
+	matched := r.hostOverrides(server)
+	r.m.Unlock()
+	for _, l := range matched {
+		l.Wait()
+	}
+	r.server(ip.String()).Wait()
+}
+
+// Record adjusts the rate for the address based on the response
+func (r *rateLimiter) Record(server string, ip net.IP, in *dns.Msg, err error) {
+	if r.serverQPS <= 0 {
+		return
+	}
+	var netErr net.Error
+	bad := (errors.As(err, &netErr) && netErr.Timeout()) || (in != nil && in.Rcode == dns.RcodeRefused)
+
+	s := r.server(ip.String())
+	s.cm.Lock()
+	s.responses++
+	if bad {
+		s.bad++
+	}
+	if s.responses < rateWindow {
+		s.cm.Unlock()
+		return
+	}
+	ratio := float64(s.bad) / float64(s.responses)
+	s.responses, s.bad = 0, 0
+	s.cm.Unlock()
+
+	rate := s.Rate()
+	switch {
+	case ratio >= rateSlowRatio && rate > rateMin:
+		rate = math.Max(rate/2, rateMin)
+		v("slowing down queries to %s to %.1f/s, %.0f%% timeouts or REFUSED", serverAddr(server, ip.String()), rate, ratio*100)
+		s.SetRate(rate)
+	case ratio == 0 && rate < r.serverQPS:
+		rate = math.Min(rate*2, r.serverQPS)
+		v("speeding up queries to %s to %.1f/s", serverAddr(server, ip.String()), rate)
+		s.SetRate(rate)
+	}
+}
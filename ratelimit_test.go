@@ -0,0 +1,78 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestRateLimiterAdapts(t *testing.T) {
+	r := newRateLimiter(0, 10, nil)
+	server, ip := "ns1.example.test", net.ParseIP("192.0.2.1")
+
+	refused := new(dns.Msg)
+	refused.Rcode = dns.RcodeRefused
+	for i := 0; i < rateWindow; i++ {
+		r.Record(server, ip, refused, nil)
+	}
+	if got := r.server(ip.String()).Rate(); got != 5 {
+		t.Fatalf("rate after a window of REFUSED = %.1f, want 5", got)
+	}
+
+	for i := 0; i < rateWindow; i++ {
+		r.Record(server, ip, new(dns.Msg), nil)
+	}
+	if got := r.server(ip.String()).Rate(); got != 10 {
+		t.Errorf("rate after a clean window = %.1f, want 10", got)
+	}
+}
+
+func TestParseRateOverrides(t *testing.T) {
+	got, err := parseRateOverrides("com=50,NS1.Example.NET.=5")
+	if err != nil {
+		t.Fatalf("parseRateOverrides() error: %s", err)
+	}
+	if got["com"] != 50 || got["ns1.example.net"] != 5 {
+		t.Errorf("parseRateOverrides() = %v", got)
+	}
+	if _, err := parseRateOverrides("com"); err == nil {
+		t.Errorf("parseRateOverrides(%q) did not error", "com")
+	}
+}
+
+func TestRateOverrides(t *testing.T) {
+	overrides, err := parseRateOverrides("com=50,ns1.example.net=5,*.example.org=20")
+	if err != nil {
+		t.Fatalf("parseRateOverrides() error: %s", err)
+	}
+	r := newRateLimiter(0, 0, overrides)
+	r.AddZone("com", []string{"a.gtld-servers.net", "b.gtld-servers.net"})
+	r.AddZone("example.com", []string{"ns1.example.com"})
+	for server, want := range map[string]int{
+		"a.gtld-servers.net": 1,
+		"ns1.example.com":    0, // under com and answering for example.com, but not a com server
+		"ns1.example.net":    1,
+		"ns2.example.net":    0,
+		"ns1.example.org":    1,
+		"example.org":        0,
+	} {
+		if got := len(r.hostOverrides(server)); got != want {
+			t.Errorf("hostOverrides(%q) = %d limiters, want %d", server, got, want)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+// Copyright 2022 Google LLC
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+
+//     https://www.apache.org/licenses/LICENSE-2.0
+
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// max number of referrals to follow when resolving a single name
+	maxReferrals = 16
+	// max depth of nested nameserver lookups, ex: resolving the address of a nameserver for a nameserver
+	maxResolveDepth = 8
+)
+
+var (
+	errResolveDepth = errors.New("max resolve depth reached")
+	errNXDomain     = errors.New("NXDOMAIN")
+)
+
+// addrCache holds the addresses of nameserver hosts for each address family, learned from glue or resolved iteratively.
+// Unlike cache.Cache, lookups never block on another worker so that nested lookups can not deadlock.
+type addrCache struct {
+	m       sync.RWMutex
+	entries map[addrKey]*addrEntry
+}
+
+type addrKey struct {
+	host  string
+	qtype uint16
+}
+
+type addrEntry struct {
+	ips []net.IP
+	err error
+}
+
+var nsAddrs = newAddrCache()
+
+func newAddrCache() *addrCache {
+	var c addrCache
+	c.entries = make(map[addrKey]*addrEntry)
+	return &c
+}
+
+// Add merges the provided addresses into the addresses known for host
+func (c *addrCache) Add(host string, ips ...net.IP) {
+	host = cleanDomain(host)
+	c.m.Lock()
+	defer c.m.Unlock()
+	for _, ip := range ips {
+		key := addrKey{host, ipQtype(ip)}
+		e, ok := c.entries[key]
+		if !ok || e.err != nil {
+			e = &addrEntry{}
+			c.entries[key] = e
+		}
+		if !containsIP(e.ips, ip) {
+			e.ips = append(e.ips, ip)
+		}
+	}
+}
+
+// Set records the result of resolving the addresses of host for qtype
+func (c *addrCache) Set(host string, qtype uint16, ips []net.IP, err error) {
+	host = cleanDomain(host)
+	c.m.Lock()
+	defer c.m.Unlock()
+	key := addrKey{host, qtype}
+	if e, ok := c.entries[key]; ok && len(e.ips) > 0 && len(ips) == 0 {
+		// keep addresses already learned from glue
+		return
+	}
+	c.entries[key] = &addrEntry{ips: ips, err: err}
+}
+
+// Get returns the addresses or error cached for host and qtype, bool is false if nothing is cached yet
+func (c *addrCache) Get(host string, qtype uint16) ([]net.IP, error, bool) {
+	host = cleanDomain(host)
+	c.m.RLock()
+	defer c.m.RUnlock()
+	e, ok := c.entries[addrKey{host, qtype}]
+	if !ok {
+		return nil, nil, false
+	}
+	return append([]net.IP(nil), e.ips...), e.err, true
+}
+
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveNS returns all the addresses of a nameserver host in the address families being queried
+func resolveNS(host string) ([]net.IP, error) {
+	return resolveHost(host, 0)
+}
+
+func resolveHost(host string, depth int) ([]net.IP, error) {
+	host = cleanDomain(host)
+
+	var out []net.IP
+	var err error
+	for _, qtype := range queryQtypes() {
+		ips, qErr, ok := nsAddrs.Get(host, qtype)
+		if !ok {
+			if depth > maxResolveDepth {
+				qErr = errResolveDepth
+			} else {
+				ips, qErr = resolveIterative(host, qtype, depth)
+				nsAddrs.Set(host, qtype, ips, qErr)
+			}
+		}
+		if qErr != nil {
+			v("resolveHost(%q) %s error: %s", host, dns.TypeToString[qtype], qErr)
+			err = qErr
+		}
+		out = append(out, ips...)
+	}
+
+	if len(out) == 0 {
+		if err == nil {
+			err = fmt.Errorf("no addresses found for %q", host)
+		}
+		return nil, err
+	}
+	sortIPs(out)
+	return out, nil
+}
+
+// lookup follows referrals from the closest known servers down to the servers authoritative for name,
+// and returns their response
+func lookup(name string, qtype uint16, depth int) (*dns.Msg, error) {
+	if depth > maxResolveDepth {
+		return nil, errResolveDepth
+	}
+	name = dns.Fqdn(name)
+	servers := closestServers(name)
+
+	for i := 0; i < maxReferrals; i++ {
+		in, err := queryAny(servers, name, qtype, depth)
+		if err != nil {
+			return nil, err
+		}
+		if in.Rcode != dns.RcodeSuccess || len(in.Answer) > 0 || in.Authoritative {
+			return in, nil
+		}
+
+		// referral
+		next := make([]string, 0, len(in.Ns))
+		for _, r := range in.Ns {
+			if t, ok := r.(*dns.NS); ok {
+				next = append(next, cleanDomain(t.Ns))
+			}
+		}
+		if len(next) == 0 {
+			return nil, fmt.Errorf("%s %s: no answer or referral", name, dns.TypeToString[qtype])
+		}
+		addGlue(in, next)
+		servers = next
+	}
+	return nil, fmt.Errorf("%s %s: too many referrals", name, dns.TypeToString[qtype])
+}
+
+// resolveIterative looks up the addresses of name, following any CNAMEs
+func resolveIterative(name string, qtype uint16, depth int) ([]net.IP, error) {
+	in, err := lookup(name, qtype, depth)
+	if err != nil {
+		return nil, err
+	}
+	if in.Rcode == dns.RcodeNameError {
+		return nil, fmt.Errorf("%s %s: %w", dns.Fqdn(name), dns.TypeToString[qtype], errNXDomain)
+	}
+	if in.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("%s %s: %s", dns.Fqdn(name), dns.TypeToString[qtype], dns.RcodeToString[in.Rcode])
+	}
+	ips, target := addrsFromAnswer(in, name, qtype)
+	if len(ips) == 0 && target != "" {
+		// the answer was an alias to a name that lives elsewhere
+		return resolveIterative(target, qtype, depth+1)
+	}
+	return ips, nil
+}
+
+// addrsFromAnswer returns the addresses for name in the answer section, following any CNAME chain in the answer
+// if the chain leaves the answer section, the final target is returned instead
+func addrsFromAnswer(in *dns.Msg, name string, qtype uint16) ([]net.IP, string) {
+	owner := dns.CanonicalName(name)
+	for i := 0; i < len(in.Answer); i++ {
+		found := false
+		for _, r := range in.Answer {
+			if t, ok := r.(*dns.CNAME); ok && dns.CanonicalName(t.Hdr.Name) == owner {
+				owner = dns.CanonicalName(t.Target)
+				found = true
+				break
+			}
+		}
+		if !found {
+			break
+		}
+	}
+
+	var out []net.IP
+	for _, r := range in.Answer {
+		if dns.CanonicalName(r.Header().Name) != owner || r.Header().Rrtype != qtype {
+			continue
+		}
+		switch t := r.(type) {
+		case *dns.A:
+			out = append(out, t.A)
+		case *dns.AAAA:
+			out = append(out, t.AAAA)
+		}
+	}
+	if len(out) == 0 && owner != dns.CanonicalName(name) {
+		return nil, owner
+	}
+	return out, ""
+}
+
+// queryAny sends the query to each server address in turn until one responds
+func queryAny(servers []string, name string, qtype uint16, depth int) (*dns.Msg, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	m.RecursionDesired = false
+
+	var err error = fmt.Errorf("no servers to query for %s", name)
+	for _, server := range servers {
+		ips, rErr := resolveHost(server, depth+1)
+		if rErr != nil {
+			err = rErr
+			continue
+		}
+		for _, ip := range ips {
+			in, qErr := exchange(m, server, ip, transportUDP)
+			if qErr != nil {
+				err = qErr
+				continue
+			}
+			if in.Rcode == dns.RcodeServerFailure || in.Rcode == dns.RcodeRefused {
+				err = fmt.Errorf("%s [%s]: %s", server, ip, dns.RcodeToString[in.Rcode])
+				continue
+			}
+			return in, nil
+		}
+	}
+	return nil, err
+}
+
+// closestServers returns the nameservers of the closest parent of name that the walk already found
+func closestServers(name string) []string {
+	if seen != nil {
+		for _, label := range SplitDomainNameWithParent(cleanDomain(name)) {
+			if servers, ok := seen.Get(label); ok && len(servers) > 0 {
+				return servers
+			}
+		}
+	}
+	return rootServers
+}
+
+// addGlue adds the glue in a referral for the provided nameservers to the address cache
+func addGlue(in *dns.Msg, nameservers []string) {
+	for host, ips := range glueAddrs(in, nameservers) {
+		nsAddrs.Add(host, ips...)
+	}
+}
+
+// glueAddrs returns the A/AAAA records in the additional section of a referral for the provided nameservers.
+// Only addresses of nameservers inside the zone delegated to them are taken, anything else could be made up by
+// the server to poison the addresses used for other zones.
+func glueAddrs(in *dns.Msg, nameservers []string) map[string][]net.IP {
+	out := make(map[string][]net.IP)
+	if in.Authoritative || len(in.Answer) > 0 {
+		return out
+	}
+	wanted := StringArrayToMap(nameservers)
+	zones := make(map[string]string) // zone delegated to each nameserver
+	for _, r := range in.Ns {
+		if t, ok := r.(*dns.NS); ok && wanted[cleanDomain(t.Ns)] {
+			zones[cleanDomain(t.Ns)] = t.Hdr.Name
+		}
+	}
+	for _, r := range in.Extra {
+		owner := cleanDomain(r.Header().Name)
+		zone, ok := zones[owner]
+		if !ok || !dns.IsSubDomain(zone, r.Header().Name) {
+			continue
+		}
+		switch t := r.(type) {
+		case *dns.A:
+			out[owner] = append(out[owner], t.A)
+		case *dns.AAAA:
+			out[owner] = append(out[owner], t.AAAA)
+		}
+	}
+	return out
+}
+
+// queryQtypes returns the address record types for the address families being queried
+func queryQtypes() []uint16 {
+	out := make([]uint16, 0, 2)
+	if queryIPv4 {
+		out = append(out, dns.TypeA)
+	}
+	if queryIPv6 {
+		out = append(out, dns.TypeAAAA)
+	}
+	return out
+}
+
+func ipQtype(ip net.IP) uint16 {
+	if ip.To4() != nil {
+		return dns.TypeA
+	}
+	return dns.TypeAAAA
+}
+
+const (
+	familyIPv4 = "IPv4"
+	familyIPv6 = "IPv6"
+)
+
+// ipFamily returns the name of the address family of ip for findings
+func ipFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return familyIPv4
+	}
+	return familyIPv6
+}
+
+func sortIPs(ips []net.IP) {
+	sort.Slice(ips, func(i, j int) bool {
+		return bytes.Compare(ips[i].To16(), ips[j].To16()) < 0
+	})
+}
@@ -25,11 +25,13 @@ import (
 type LameStats struct {
 	Total    uint
 	Lame     uint
+	LameIPv4 uint
+	LameIPv6 uint
 	Problems uint
 }
 
 func (s *LameStats) String() string {
-	return fmt.Sprintf("STATS: %d/%d lame delegations and %d problems", s.Lame, s.Total, s.Problems)
+	return fmt.Sprintf("STATS: %d/%d lame delegations (%d over IPv4, %d over IPv6) and %d problems", s.Lame, s.Total, s.LameIPv4, s.LameIPv6, s.Problems)
 }
 
 func saver(ctx context.Context, saveChan chan jobs.Job, wg *sync.WaitGroup) error {
@@ -53,6 +55,12 @@ func saver(ctx context.Context, saveChan chan jobs.Job, wg *sync.WaitGroup) erro
 				if d.Lame {
 					stats.Lame++
 				}
+				if d.LameIPv4 {
+					stats.LameIPv4++
+				}
+				if d.LameIPv6 {
+					stats.LameIPv6++
+				}
 				stats.Problems += d.Problems
 			default:
 				log.Fatalf("ERROR: saver: don't know about type %T!\n%+v\n", v, d)
@@ -22,6 +22,8 @@ import (
 type nameWork struct {
 	Name     string
 	Lame     bool
+	LameIPv4 bool
+	LameIPv6 bool
 	Problems uint
 }
 
@@ -31,6 +33,7 @@ func processName(ctx context.Context, w *nameWork) error {
 
 	// get labels
 	labels := SplitDomainNameWithParent(w.Name)
+	deps.AddInput(w.Name, labels)
 
 	action := false
 
@@ -76,14 +79,66 @@ func processName(ctx context.Context, w *nameWork) error {
 			if err != nil {
 				return err
 			}
+			limits.AddZone(labels[i], result.NS)
 
 			w.Problems += checkEqualResultResponse(result)
 
-			w.Lame = checkLame(result)
+			lame, auth := checkLame(result)
+			w.Lame, w.LameIPv4, w.LameIPv6 = lame.Lame, lame.IPv4, lame.IPv6
 			if w.Lame {
 				w.Problems++
 			}
 
+			// every nameserver host seen for the name, from the parent and the authoritative servers
+			hosts := result.NS
+			if auth != nil {
+				hosts = append(ExtraStrings(auth.NS, result.NS), result.NS...)
+			}
+			deps.AddZone(labels[i], hosts...)
+			if glue, referral := parentGlue(result); referral {
+				glued := make(map[string]bool)
+				for host := range glue {
+					glued[host] = true
+				}
+				deps.AddDelegation(labels[i], result.NS, glued)
+			}
+			walkNSHostZones(hosts)
+			w.Problems += checkDanglingNS(hosts)
+			if registrableDomain(labels[i]) != "" {
+				// the nameservers of a public suffix are held by its own registry, with or without a delegation
+				w.Problems += checkRegisteredNS(hosts)
+			}
+			w.Problems += checkNSTargets(labels[i], hosts)
+			w.Problems += checkNSAddrs(result, auth)
+
+			if auth != nil {
+				w.Problems += checkGlue(result, auth)
+				w.Problems += checkNSTTL(result, auth)
+				w.Problems += checkDiversity(auth)
+				w.Problems += checkSOA(auth)
+				if *tcpCheck {
+					w.Problems += checkTCP(auth)
+				}
+				if *ednsComp {
+					w.Problems += checkEDNS(auth)
+				}
+				if *dotCheck || len(expectedDoT) > 0 {
+					w.Problems += checkDoT(auth)
+				}
+				if *dnssec {
+					w.Problems += checkDNSSEC(result, auth)
+				}
+				if *cdsCheck {
+					w.Problems += checkCDS(auth)
+				}
+				if *axfrChk {
+					w.Problems += checkAXFR(auth)
+				}
+				if *recCheck {
+					w.Problems += checkRecursion(auth)
+				}
+			}
+
 			if i == 0 { // the full domain name, not a parent
 				// check for expected NS
 				w.Problems += checkExpectedNS(result)